@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// attemptPolicy decides how long failed attempts block further ones. The
+// first free failures don't, then the delay doubles with every failure until
+// lockoutAfter failures lock the key out for the lockout duration, which the
+// user is told about by email if notify is set.
+type attemptPolicy struct {
+	free         int
+	base         time.Duration
+	lockoutAfter int
+	lockout      time.Duration
+	notify       bool
+	// window is how long failures are remembered after the last one
+	window time.Duration
+}
+
+var (
+	accountAttempts = attemptPolicy{free: 3, base: time.Second, lockoutAfter: 10, lockout: 15 * time.Minute, notify: true, window: time.Hour}
+	ipAttempts      = attemptPolicy{free: 10, base: time.Second, lockoutAfter: 50, lockout: 15 * time.Minute, window: time.Hour}
+	// activation codes are short, so wrong ones are counted per account across
+	// the codes sent to it
+	activationAttempts = attemptPolicy{free: 3, base: time.Second, lockoutAfter: 10, lockout: 15 * time.Minute, window: time.Hour}
+)
+
+func (p attemptPolicy) backoff(failures int) time.Duration {
+	switch {
+	case failures >= p.lockoutAfter:
+		return p.lockout
+	case failures < p.free:
+		return 0
+	}
+	d := p.base
+	for i := p.free; i < failures && d < p.lockout; i++ {
+		d *= 2
+	}
+	return min(d, p.lockout)
+}
+
+// attemptKey is what failed attempts are counted under.
+type attemptKey struct {
+	key    string
+	policy attemptPolicy
+}
+
+// accountAttemptKey counts by email rather than by user so that unknown emails
+// are throttled like known ones and don't stand out.
+func accountAttemptKey(email string) attemptKey {
+	return attemptKey{"account:" + strings.ToLower(email), accountAttempts}
+}
+
+func activationAttemptKey(u *user) attemptKey {
+	return attemptKey{"activation:" + strconv.Itoa(u.ID), activationAttempts}
+}
+
+func ipAttemptKey(r *http.Request) attemptKey {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return attemptKey{"ip:" + ip, ipAttempts}
+}
+
+// throttled responds with 429 if any of the keys is backing off and reports
+// whether it did.
+func (app *application) throttled(w http.ResponseWriter, r *http.Request, keys ...attemptKey) bool {
+	var wait time.Duration
+	for _, k := range keys {
+		failures, last, err := app.storage.getAuthFailures(k.key, k.policy.window)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return true
+		}
+		wait = max(wait, time.Until(last.Add(k.policy.backoff(failures))))
+	}
+	if wait <= 0 {
+		return false
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, problemTooManyFailedAttempts, fmt.Sprintf("try again in %d seconds", seconds))
+	return true
+}
+
+// recordFailedAttempt counts a failure under every key. The user, if known,
+// is emailed when a key that notifies gets locked out. Failures are written
+// outside of the transaction of an atomic batch, which the failed attempt
+// rolls back.
+func (app *application) recordFailedAttempt(u *user, keys ...attemptKey) error {
+	for _, k := range keys {
+		failures, _, err := app.storage.recordAuthFailure(k.key, k.policy.window)
+		if err != nil {
+			return err
+		}
+		if u != nil && k.policy.notify && failures == k.policy.lockoutAfter {
+			go func() {
+				err := app.sendLockoutNotice(u, failures, k.policy.lockout)
+				if err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+	}
+	return nil
+}
+
+func (app *application) sendLockoutNotice(u *user, failures int, lockout time.Duration) error {
+	tmpl, err := template.ParseFS(templates, "templates/user_lockout.gotmpl")
+	if err != nil {
+		return err
+	}
+	return app.mailer.send(u.Email, tmpl, map[string]any{
+		"failures": failures,
+		"minutes":  int(lockout.Minutes()),
+	})
+}
+
+// dummyPasswordHash is compared against when the email is unknown, so the
+// response takes as long as for a wrong password. Its cost is the one of
+// the stored hashes.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not a real password"), 13)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// codec is a representation bodies can be read from and written in. Every
+// format is transcoded through JSON so that json tags and custom marshalers
+// stay the single definition of the wire shape.
+type codec struct {
+	mediaType string
+	aliases   []string
+	marshal   func(v any) ([]byte, error)
+	unmarshal func(data []byte, v any) error
+}
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+var (
+	jsonCodec = &codec{
+		mediaType: "application/json",
+		marshal:   json.Marshal,
+		unmarshal: json.Unmarshal,
+	}
+	msgpackCodec = &codec{
+		mediaType: "application/msgpack",
+		aliases:   []string{"application/x-msgpack", "application/vnd.msgpack"},
+		marshal:   msgpack.Marshal,
+		unmarshal: msgpack.Unmarshal,
+	}
+	cborCodec = &codec{
+		mediaType: "application/cbor",
+		marshal:   cbor.Marshal,
+		unmarshal: cborDecMode.Unmarshal,
+	}
+	yamlCodec = &codec{
+		mediaType: "application/yaml",
+		aliases:   []string{"application/x-yaml", "text/yaml"},
+		marshal:   yaml.Marshal,
+		unmarshal: yaml.Unmarshal,
+	}
+)
+
+// codecs is ordered by preference, JSON is used when the client has none.
+var codecs = []*codec{jsonCodec, msgpackCodec, cborCodec, yamlCodec}
+
+func (c *codec) matches(mediaType string) bool {
+	return mediaType == c.mediaType || slices.Contains(c.aliases, mediaType)
+}
+
+// codecFor returns the codec of a Content-Type header, or nil when the type
+// isn't supported.
+func codecFor(contentType string) *codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for _, c := range codecs {
+		if c.matches(mediaType) {
+			return c
+		}
+	}
+	return nil
+}
+
+// negotiate picks the response codec with the highest quality in the Accept
+// header, it returns nil when none of the acceptable types is supported.
+func negotiate(r *http.Request) *codec {
+	if r == nil {
+		return jsonCodec
+	}
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		return jsonCodec
+	}
+
+	var best *codec
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+
+		var c *codec
+		switch {
+		case mediaType == "*/*", mediaType == "application/*", mediaType == "application/problem+json":
+			c = jsonCodec
+		default:
+			c = codecFor(mediaType)
+		}
+		if c != nil {
+			best, bestQ = c, q
+		}
+	}
+	return best
+}
+
+func supportedMediaTypes() []string {
+	mediaTypes := make([]string, len(codecs))
+	for i, c := range codecs {
+		mediaTypes[i] = c.mediaType
+	}
+	return mediaTypes
+}
+
+// encode marshals v through its JSON form.
+func (c *codec) encode(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || c == jsonCodec {
+		return data, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	err = dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return c.marshal(normalizeNumbers(doc))
+}
+
+// toJSON transcodes a body of the codec's format into JSON.
+func (c *codec) toJSON(data []byte) ([]byte, error) {
+	if c == jsonCodec {
+		return data, nil
+	}
+	var doc any
+	err := c.unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// decode unmarshals a body of the codec's format into the values
+// encoding/json produces.
+func (c *codec) decode(data []byte) (any, error) {
+	data, err := c.toJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// normalizeNumbers replaces json.Number with integers where they fit, binary
+// formats would otherwise encode every number as a float or a string.
+func normalizeNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		if err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i := range v {
+			v[i] = normalizeNumbers(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = normalizeNumbers(v[k])
+		}
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept []string
+		want   *codec
+	}{
+		{nil, jsonCodec},
+		{[]string{""}, jsonCodec},
+		{[]string{"*/*"}, jsonCodec},
+		{[]string{"application/*"}, jsonCodec},
+		{[]string{"application/problem+json"}, jsonCodec},
+		{[]string{"application/json"}, jsonCodec},
+		{[]string{"application/msgpack"}, msgpackCodec},
+		{[]string{"application/x-msgpack"}, msgpackCodec},
+		{[]string{"application/cbor"}, cborCodec},
+		{[]string{"text/yaml"}, yamlCodec},
+		{[]string{"application/json; charset=utf-8"}, jsonCodec},
+		{[]string{"application/json;q=0.5, application/cbor"}, cborCodec},
+		{[]string{"application/cbor;q=0.4, application/yaml;q=0.9"}, yamlCodec},
+		{[]string{"application/msgpack, application/cbor"}, msgpackCodec},
+		{[]string{"text/html, application/cbor;q=0.1"}, cborCodec},
+		{[]string{"application/yaml;q=0.2", "application/msgpack;q=0.8"}, msgpackCodec},
+		{[]string{"application/cbor;q=0, text/html"}, nil},
+		{[]string{"application/cbor;q=oops, application/yaml;q=0.1"}, yamlCodec},
+		{[]string{"text/html"}, nil},
+		{[]string{"text/html;q=1, ;;"}, nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/v1/tasks", nil)
+		for _, accept := range tt.accept {
+			r.Header.Add("Accept", accept)
+		}
+		got := negotiate(r)
+		if got != tt.want {
+			t.Errorf("negotiate(%q) = %v, want %v", tt.accept, mediaTypeOf(got), mediaTypeOf(tt.want))
+		}
+	}
+
+	if got := negotiate(nil); got != jsonCodec {
+		t.Errorf("negotiate(nil) = %v, want %v", mediaTypeOf(got), jsonCodec.mediaType)
+	}
+}
+
+func mediaTypeOf(c *codec) string {
+	if c == nil {
+		return "<nil>"
+	}
+	return c.mediaType
+}
+
+func TestNormalizeNumbers(t *testing.T) {
+	tests := []struct {
+		in   any
+		want any
+	}{
+		{json.Number("42"), int64(42)},
+		{json.Number("-7"), int64(-7)},
+		{json.Number("0"), int64(0)},
+		{json.Number("1.5"), 1.5},
+		{json.Number("1e3"), 1000.0},
+		{json.Number("9223372036854775808"), 9223372036854775808.0},
+		{"12", "12"},
+		{true, true},
+		{nil, nil},
+		{[]any{json.Number("1"), json.Number("2.5"), "x"}, []any{int64(1), 2.5, "x"}},
+		{
+			map[string]any{"id": json.Number("3"), "nested": map[string]any{"ratio": json.Number("0.25")}, "list": []any{json.Number("4")}},
+			map[string]any{"id": int64(3), "nested": map[string]any{"ratio": 0.25}, "list": []any{int64(4)}},
+		},
+	}
+	for _, tt := range tests {
+		got := normalizeNumbers(tt.in)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeNumbers = %#v, want %#v", got, tt.want)
+		}
+	}
+}
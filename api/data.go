@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
 
 type user struct {
 	ID           int       `json:"id"`
@@ -9,14 +13,326 @@ type user struct {
 	Email        string    `json:"email"`
 	PasswordHash []byte    `json:"-"`
 	IsActivated  bool      `json:"is_activated"`
+	UpdatedAt    time.Time `json:"updated_at"`
 	Version      int       `json:"-"`
+	// CredentialVersion is embedded in access tokens and incremented to
+	// invalidate every token issued before.
+	CredentialVersion int `json:"-"`
 }
 
 type task struct {
-	ID          int       `json:"id"`
-	CreatedAt   time.Time `json:"created_at"`
-	UserID      int       `json:"user_id"`
-	Content     string    `json:"content"`
-	IsCompleted bool      `json:"is_completed"`
-	Version     int       `json:"-"`
+	ID          int        `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      int        `json:"user_id"`
+	Content     string     `json:"content"`
+	IsCompleted bool       `json:"is_completed"`
+	CompletedAt *time.Time `json:"completed_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Version     int        `json:"-"`
+}
+
+type taskFilter struct {
+	Content       string     `json:"content,omitempty"`
+	Sort          string     `json:"sort,omitempty"`
+	IsCompleted   *bool      `json:"is_completed,omitempty"`
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	IDs           []int      `json:"ids,omitempty"`
+}
+
+type savedFilter struct {
+	ID           int        `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UserID       int        `json:"user_id"`
+	Name         string     `json:"name"`
+	Filter       taskFilter `json:"filter"`
+	LastViewedAt time.Time  `json:"last_viewed_at"`
+	NewCount     *int       `json:"new_count,omitempty"`
+	Version      int        `json:"-"`
+}
+
+type taskCounts struct {
+	Open      int `json:"open"`
+	Completed int `json:"completed"`
+	Total     int `json:"total"`
+}
+
+type taskStats struct {
+	Open                     int               `json:"open"`
+	Completed                int               `json:"completed"`
+	AverageCompletionSeconds float64           `json:"average_completion_seconds"`
+	OldestOpenTask           *task             `json:"oldest_open_task"`
+	Interval                 string            `json:"interval"`
+	Series                   []taskStatsBucket `json:"series"`
+}
+
+type taskStatsBucket struct {
+	Start     time.Time `json:"start"`
+	Created   int       `json:"created"`
+	Completed int       `json:"completed"`
+}
+
+type idempotencyRecord struct {
+	UserID      int
+	Key         string
+	ExpiresAt   time.Time
+	Fingerprint []byte
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+}
+
+// refreshToken is an opaque, single-use token exchanged for a new access token.
+// Rotating a token keeps its session, so presenting an already used token
+// revokes the session and every token issued for it.
+type refreshToken struct {
+	Hash      []byte
+	UserID    int
+	SessionID int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// session is a sign-in of a user, access and refresh tokens are bound to the
+// session they were issued for.
+type session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"-"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+// personalAccessToken authenticates scripts and integrations as a user, it's
+// limited to its scopes and can't manage the user's sessions or tokens.
+type personalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Hash       []byte     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type authTokens struct {
+	Token                 string    `json:"token"`
+	TokenExpiresAt        time.Time `json:"token_expires_at"`
+	RefreshToken          string    `json:"refresh_token"`
+	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+}
+
+type passwordResetToken struct {
+	Hash      []byte
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// emailChange is an email address the user asked to switch to, the switch
+// happens once it's confirmed with the token sent to the new address.
+type emailChange struct {
+	UserID    int       `json:"-"`
+	NewEmail  string    `json:"new_email"`
+	Hash      []byte    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// magicLink signs the user in without a password, it's only accepted
+// together with the nonce handed to the device that asked for it.
+type magicLink struct {
+	Hash       []byte
+	NonceHash  []byte
+	UserID     int
+	DeviceName string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// mfaChallenge is returned instead of tokens when the user has two-factor
+// authentication enabled, the tokens are issued for the MFA token once a code
+// is verified.
+type mfaChallenge struct {
+	MFAToken          string    `json:"mfa_token"`
+	MFATokenExpiresAt time.Time `json:"mfa_token_expires_at"`
+	Methods           []string  `json:"methods"`
+}
+
+type totpCredential struct {
+	UserID       int
+	Secret       []byte
+	CreatedAt    time.Time
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+type totpEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode string `json:"qr_code"`
+}
+
+type healthCheck struct {
+	Status      string `json:"status"`
+	Environment string `json:"environment"`
+	Version     string `json:"version"`
+}
+
+type createUserInput struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type updateUserInput struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword *string `json:"current_password"`
+}
+
+type createTaskInput struct {
+	Content *string `json:"content"`
+}
+
+type updateTaskInput struct {
+	Content     *string `json:"content"`
+	IsCompleted *bool   `json:"is_completed"`
+}
+
+type createFilterInput struct {
+	Name   string     `json:"name"`
+	Filter taskFilter `json:"filter"`
+}
+
+type updateFilterInput struct {
+	Name   *string     `json:"name"`
+	Filter *taskFilter `json:"filter"`
+}
+
+type activateUserInput struct {
+	Code *int `json:"code"`
+}
+
+type authenticateUserInput struct {
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
+}
+
+type refreshTokenInput struct {
+	RefreshToken *string `json:"refresh_token"`
+}
+
+type createPersonalAccessTokenInput struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type requestPasswordResetInput struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordInput struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type confirmEmailChangeInput struct {
+	Token string `json:"token"`
+}
+
+type requestMagicLinkInput struct {
+	Email      string `json:"email"`
+	DeviceName string `json:"device_name"`
+}
+
+type verifyMagicLinkInput struct {
+	Token string `json:"token"`
+	Nonce string `json:"nonce"`
+}
+
+type totpCodeInput struct {
+	Code string `json:"code"`
+}
+
+type verifyMFAInput struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type passwordInput struct {
+	Password string `json:"password"`
+}
+
+type batchInput struct {
+	Atomic   bool `json:"atomic"`
+	Requests []struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	} `json:"requests"`
+}
+
+type batchResponse struct {
+	Status  int             `json:"status"`
+	Headers http.Header     `json:"headers"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// The v2 shapes replace the completion flag of tasks with a status so that
+// more states can be added without another breaking change. Handlers work on
+// the v1 types, these only describe the v2 wire format.
+
+const (
+	taskStatusOpen      = "open"
+	taskStatusCompleted = "completed"
+)
+
+type taskV2 struct {
+	ID          int        `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      int        `json:"user_id"`
+	Content     string     `json:"content"`
+	Status      string     `json:"status"`
+	CompletedAt *time.Time `json:"completed_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+type taskFilterV2 struct {
+	Content       string     `json:"content,omitempty"`
+	Sort          string     `json:"sort,omitempty"`
+	Status        *string    `json:"status,omitempty"`
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	IDs           []int      `json:"ids,omitempty"`
+}
+
+type updateTaskInputV2 struct {
+	Content *string `json:"content"`
+	Status  *string `json:"status"`
+}
+
+type apiVersionInfo struct {
+	Name        string       `json:"name"`
+	Status      string       `json:"status"`
+	Deprecation *time.Time   `json:"deprecation,omitempty"`
+	Sunset      *time.Time   `json:"sunset,omitempty"`
+	Successor   string       `json:"successor,omitempty"`
+	Usage       []routeUsage `json:"usage"`
+}
+
+type routeUsage struct {
+	Route         string    `json:"route"`
+	Requests      int64     `json:"requests"`
+	LastRequestAt time.Time `json:"last_request_at"`
 }
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"math/rand/v2"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,28 +30,19 @@ import (
 var templates embed.FS
 
 func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	heathCheck := struct {
-		Status      string `json:"status"`
-		Environment string `json:"environment"`
-		Version     string `json:"version"`
-	}{
+	heathCheck := healthCheck{
 		Status:      "available",
 		Environment: app.config.env,
 		Version:     version,
 	}
-	writeJSON(w, heathCheck, http.StatusOK)
+	writeResponse(w, r, heathCheck, http.StatusOK)
 }
 
 func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input createUserInput
 
-	err := json.NewDecoder(r.Body).Decode(&input)
-	if err != nil {
-		writeError(w, err, http.StatusBadRequest)
+	ok := app.readRequest(w, r, &input)
+	if !ok {
 		return
 	}
 
@@ -52,25 +52,25 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 	v.checkEmail(input.Email)
 	v.checkPassword(input.Password)
 	if v.hasErrors() {
-		writeError(w, v.toError(), http.StatusBadRequest)
+		writeValidationError(w, r, problemValidationFailed, v)
 		return
 	}
 
-	u, err := app.storage.getUserByEmail(input.Email)
+	u, err := app.storageFor(r).getUserByEmail(input.Email)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
 	if u != nil {
-		writeError(w, errors.New("user already exists"), http.StatusConflict)
+		writeError(w, r, problemUserExists, "")
 		return
 	}
 
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(input.Password), 13)
 	if err != nil {
 		log.Println(err)
-		writeError(w, err, http.StatusConflict)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
@@ -79,507 +79,1793 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		Email:        input.Email,
 		PasswordHash: passwordHash,
 	}
-	err = app.storage.insertUser(u)
+	err = app.storageFor(r).insertUser(u)
 	if err != nil {
 		log.Println(err)
-		writeError(w, err, http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
-	tmpl, err := template.ParseFS(templates, "templates/*.gotmpl")
+	tmpl, err := template.ParseFS(templates, "templates/user_activation.gotmpl")
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 	code := uint16(rand.Uint())
 	err = app.mailer.send(u.Email, tmpl, map[string]any{"code": code})
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
-	app.storage.useractivationCache.Set(u, code, time.Minute)
-	writeJSON(w, map[string]any{"user": u, "message": fmt.Sprintf("we have sent an activation code to your email: %s", u.Email)}, http.StatusCreated)
+	app.storageFor(r).useractivationCache.Set(u, code, time.Minute)
+	w.Header().Set("ETag", composeETag(u.Version))
+	writeResponse(w, r, map[string]any{"user": u, "message": fmt.Sprintf("we have sent an activation code to your email: %s", u.Email)}, http.StatusCreated)
 }
 
 func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input updateUserInput
 
-	err := json.NewDecoder(r.Body).Decode(&input)
-	if err != nil {
-		writeError(w, err, http.StatusBadRequest)
+	ok := app.readRequest(w, r, &input)
+	if !ok {
 		return
 	}
 
 	v := newValidator()
-
-	if input.Name != "" {
-		v.checkCond(input.Name != "", "name", "must be provided")
-		v.checkCond(len(input.Name) <= 255, "name", "must be atmost 255 characters")
-	}
-
-	if input.Email != "" {
-		v.checkEmail(input.Email)
+	v.checkCond(input.Name != nil, "name", "must be provided")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
 	}
 
-	if input.Password != "" {
-		v.checkPassword(input.Password)
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
+		return
 	}
-
-	v.checkCond(input.Name != "" || input.Email != "" || input.Password != "", "name or email or password", "atleast one must be provided")
-
-	if v.hasErrors() {
-		writeError(w, v.toError(), http.StatusBadRequest)
+	if !checkIfMatch(w, r, user.Version) {
 		return
 	}
+	app.saveUser(w, r, user, *input.Name, input.Email, input.Password, input.CurrentPassword)
+}
 
+func (app *application) patchUserHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromRequest(r)
 	if user == nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if !checkIfMatch(w, r, user.Version) {
 		return
 	}
 
-	u, err := app.storage.getUserByEmail(input.Email)
-	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	var input struct {
+		ID              int       `json:"id"`
+		CreatedAt       time.Time `json:"created_at"`
+		Name            *string   `json:"name"`
+		Email           *string   `json:"email"`
+		Password        *string   `json:"password"`
+		CurrentPassword *string   `json:"current_password"`
+		IsActivated     bool      `json:"is_activated"`
+		UpdatedAt       time.Time `json:"updated_at"`
+	}
+	ok := app.readPatch(w, r, user, &input)
+	if !ok {
 		return
 	}
 
-	if u != nil {
-		writeError(w, errors.New("email is already in use"), http.StatusConflict)
+	v := newValidator()
+	v.checkCond(input.ID == user.ID, "id", "is read-only")
+	v.checkCond(input.CreatedAt.Equal(user.CreatedAt), "created_at", "is read-only")
+	v.checkCond(input.IsActivated == user.IsActivated, "is_activated", "is read-only")
+	v.checkCond(input.UpdatedAt.Equal(user.UpdatedAt), "updated_at", "is read-only")
+	v.checkCond(input.Name != nil, "name", "must not be removed")
+	v.checkCond(input.Email != nil, "email", "must not be removed")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemInvalidPatchResult, v)
 		return
 	}
+	app.saveUser(w, r, user, *input.Name, input.Email, input.Password, input.CurrentPassword)
+}
 
-	if input.Name != "" {
-		user.Name = input.Name
+// saveUser validates and persists a full replacement of the user's name, the
+// email and password are only changed when given. A new email address is only
+// switched to once it's confirmed, see confirmEmailChangeHandler. The password
+// is only changed with the current one, so a stolen session can't take over
+// the account.
+func (app *application) saveUser(w http.ResponseWriter, r *http.Request, user *user, name string, email, password, currentPassword *string) {
+	v := newValidator()
+	v.checkCond(name != "", "name", "must be provided")
+	v.checkCond(len(name) <= 255, "name", "must be atmost 255 characters")
+	if email != nil {
+		v.checkEmail(*email)
+	}
+	if password != nil {
+		v.checkPassword(*password)
+		v.checkCond(currentPassword != nil && *currentPassword != "", "current_password", "must be provided to change the password")
+	}
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+	if password != nil && !app.checkPassword(w, r, user, *currentPassword) {
+		return
 	}
 
-	if input.Email != "" {
-		user.Email = input.Email
+	// emails are case insensitive, a change of case is the same address
+	changeEmail := email != nil && !strings.EqualFold(*email, user.Email)
+	if changeEmail {
+		u, err := app.storageFor(r).getUserByEmail(*email)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		if u != nil {
+			writeError(w, r, problemEmailInUse, "")
+			return
+		}
+	} else if email != nil {
+		user.Email = *email
 	}
 
-	if input.Password != "" {
-		passwordHash, err := bcrypt.GenerateFromPassword([]byte(input.Password), 13)
+	user.Name = name
+	if password != nil {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(*password), 13)
 		if err != nil {
 			log.Println(err)
-			writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+			writeError(w, r, problemInternal, "")
 			return
 		}
 		user.PasswordHash = passwordHash
+		// tokens issued with the old password stop being accepted
+		user.CredentialVersion++
+	}
+
+	err := app.storageFor(r).updateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, errEditConflict):
+			app.writeUserConflict(w, r, user.ID)
+		default:
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+		}
+		return
+	}
+	if password != nil {
+		err = app.storageFor(r).deleteSessionsForUser(user)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		err = app.storageFor(r).deletePersonalAccessTokensForUser(user)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+	}
+	w.Header().Set("ETag", composeETag(user.Version))
+	if changeEmail {
+		// the change is only started once the rest of the update went through,
+		// a conflict mustn't leave a change behind that the client doesn't know of
+		change, err := app.startEmailChange(r, user, *email)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		writeResponse(w, r, map[string]any{"user": user, "email_change": change}, http.StatusOK)
+		return
+	}
+	writeResponse(w, r, map[string]any{"user": user}, http.StatusOK)
+}
+
+// startEmailChange stores the pending change and sends a confirmation token to
+// the new address and a notice to the current one, the user keeps signing in
+// with the current address until the change is confirmed. The emails are sent
+// in the background once the change is committed, the update they follow has
+// already succeeded whether they are delivered or not.
+func (app *application) startEmailChange(r *http.Request, u *user, email string) (*emailChange, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
 	}
+	hash := sha256.Sum256([]byte(token))
+	c := &emailChange{
+		UserID:    u.ID,
+		NewEmail:  email,
+		Hash:      hash[:],
+		ExpiresAt: time.Now().Add(emailChangeTokenTTL),
+	}
+	s := app.storageFor(r)
+	err = s.insertEmailChange(c)
+	if err != nil {
+		return nil, err
+	}
+	current := u.Email
+	s.onCommit(func() {
+		go func() {
+			err := app.sendEmailChange(current, email, token)
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	})
+	return c, nil
+}
+
+func (app *application) sendEmailChange(current, email, token string) error {
+	tmpl, err := template.ParseFS(templates, "templates/user_email_change.gotmpl")
+	if err != nil {
+		return err
+	}
+	notice, err := template.ParseFS(templates, "templates/user_email_change_notice.gotmpl")
+	if err != nil {
+		return err
+	}
+	err = app.mailer.send(email, tmpl, map[string]any{"token": token})
+	if err != nil {
+		return err
+	}
+	return app.mailer.send(current, notice, map[string]any{"email": email})
+}
+
+func (app *application) getEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	c, err := app.storageFor(r).getEmailChange(getUserFromRequest(r).ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if c == nil {
+		writeError(w, r, problemEmailChangeNotFound, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"email_change": c}, http.StatusOK)
+}
 
-	err = app.storage.updateUser(user)
+func (app *application) cancelEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	found, err := app.storageFor(r).deleteEmailChange(getUserFromRequest(r).ID)
 	if err != nil {
 		log.Println(err)
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if !found {
+		writeError(w, r, problemEmailChangeNotFound, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "email change cancelled"}, http.StatusOK)
+}
+
+var errInvalidEmailChange = errors.New("invalid email change token")
+
+// confirmEmailChangeHandler switches the user to the new address, the token
+// proves its ownership so the request needs no session.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input confirmEmailChangeInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkCond(input.Token != "", "token", "must be provided")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	hash := sha256.Sum256([]byte(input.Token))
+	var u *user
+	// the token is only used up together with the switch, a failure leaves it
+	// for another attempt
+	err := app.inTx(r, func(r *http.Request) error {
+		c, err := app.storageFor(r).useEmailChange(hash[:])
+		if err != nil {
+			return err
+		}
+		if c == nil || time.Now().After(c.ExpiresAt) {
+			return errInvalidEmailChange
+		}
+		// the address may have been registered since the change was requested
+		other, err := app.storageFor(r).getUserByEmail(c.NewEmail)
+		if err != nil {
+			return err
+		}
+		if other != nil {
+			return errDuplicateEmail
+		}
+		u, err = app.storageFor(r).getUserByID(c.UserID)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			return errInvalidEmailChange
+		}
+		u.Email = c.NewEmail
+		return app.storageFor(r).updateUser(u)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidEmailChange):
+			writeError(w, r, problemInvalidEmailChange, "")
+		case errors.Is(err, errDuplicateEmail):
+			writeError(w, r, problemEmailInUse, "")
+		case errors.Is(err, errEditConflict):
+			app.writeUserConflict(w, r, u.ID)
+		default:
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+		}
 		return
 	}
-	writeJSON(w, map[string]any{"user": user}, http.StatusOK)
+	w.Header().Set("ETag", composeETag(u.Version))
+	writeResponse(w, r, map[string]any{"user": u}, http.StatusOK)
 }
 
 func (app *application) getUserHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromRequest(r)
 	if user == nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
-	writeJSON(w, map[string]any{"user": user}, http.StatusOK)
+	w.Header().Set("ETag", composeETag(user.Version))
+	writeResponse(w, r, map[string]any{"user": user}, http.StatusOK)
 }
 
 func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromRequest(r)
 	if user == nil {
-		writeError(w, errors.New("user doesn't exist"), http.StatusNotFound)
+		writeError(w, r, problemUserNotFound, "")
+		return
+	}
+
+	if !checkIfMatch(w, r, user.Version) {
 		return
 	}
 
-	err := app.storage.deleteUser(user)
+	err := app.storageFor(r).deleteUser(user)
 	if err != nil {
-		log.Println(err)
-		writeError(w, err, http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, errEditConflict):
+			app.writeUserConflict(w, r, user.ID)
+		default:
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+		}
 		return
 	}
-	writeJSON(w, map[string]any{"message": "user successfully deleted"}, http.StatusOK)
+	writeResponse(w, r, map[string]any{"message": "user successfully deleted"}, http.StatusOK)
 }
 
 func (app *application) createTaskHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Content *string `json:"content"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&input)
-	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	var input createTaskInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
 		return
 	}
 	v := newValidator()
 	v.checkCond(input.Content != nil, "content", "must be provided")
 	v.checkCond(input.Content != nil && *input.Content != "", "content", "content must not be empty")
 	if v.hasErrors() {
-		writeError(w, v.toError(), http.StatusBadRequest)
+		writeValidationError(w, r, problemValidationFailed, v)
 		return
 	}
 	user := getUserFromRequest(r)
 	if user == nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 	t := &task{
 		Content: *input.Content,
 		UserID:  user.ID,
 	}
-	err = app.storage.insertTask(user, t)
+	err := app.storageFor(r).insertTask(user, t)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
-	writeJSON(w, map[string]any{"task": t}, http.StatusCreated)
+	w.Header().Set("ETag", composeETag(t.Version))
+	writeResponse(w, r, map[string]any{"task": t}, http.StatusCreated)
 }
 
 func (app *application) updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil || id < -1 {
-		writeError(w, errors.New("route paramter {id}: must to be a positive integer"), http.StatusBadRequest)
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
 		return
 	}
 
-	var input struct {
-		Content     *string `json:"content"`
-		IsCompleted *bool   `json:"is_completed"`
-	}
+	var input updateTaskInput
 
-	err = json.NewDecoder(r.Body).Decode(&input)
-	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	ok := app.readRequest(w, r, &input)
+	if !ok {
 		return
 	}
 
 	v := newValidator()
-	if input.Content != nil {
-		v.checkCond(*input.Content != "", "content", "must not be empty")
-	}
-	v.checkCond(input.Content != nil || input.IsCompleted != nil, "content or is_completed", "must be provided")
+	v.checkCond(input.Content != nil, "content", "must be provided")
+	v.checkCond(input.IsCompleted != nil, "is_completed", "must be provided")
 	if v.hasErrors() {
-		writeError(w, v.toError(), http.StatusBadRequest)
+		writeValidationError(w, r, problemValidationFailed, v)
 		return
 	}
 
 	user := getUserFromRequest(r)
 	if user == nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
-	t, err := app.storage.getTaskByID(id)
+	t, err := app.storageFor(r).getTaskByID(id)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 	if t == nil {
-		writeError(w, errors.New("resource doesn't exist"), http.StatusNotFound)
+		writeError(w, r, problemTaskNotFound, "")
 		return
 	}
 	if t.UserID != user.ID {
-		writeError(w, errors.New("access denied"), http.StatusConflict)
+		writeError(w, r, problemAccessDenied, "")
 		return
 	}
-	if input.Content != nil {
-		t.Content = *input.Content
-	}
-	if input.IsCompleted != nil {
-		t.IsCompleted = *input.IsCompleted
-	}
-	err = app.storage.updateTask(t)
-	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	if !checkIfMatch(w, r, t.Version) {
 		return
 	}
-	writeJSON(w, map[string]any{"task": t}, http.StatusOK)
+	app.saveTask(w, r, t, *input.Content, *input.IsCompleted)
 }
 
-func (app *application) getTaskHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) patchTaskHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil || id < -1 {
-		writeError(w, errors.New("route paramter {id}: must to be a positive integer"), http.StatusBadRequest)
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
 		return
 	}
 
 	user := getUserFromRequest(r)
 	if user == nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
-	t, err := app.storage.getTaskByID(id)
+	t, err := app.storageFor(r).getTaskByID(id)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 	if t == nil {
-		writeError(w, errors.New("resource doesn't exist"), http.StatusNotFound)
+		writeError(w, r, problemTaskNotFound, "")
 		return
 	}
 	if t.UserID != user.ID {
-		writeError(w, errors.New("access denied"), http.StatusConflict)
+		writeError(w, r, problemAccessDenied, "")
 		return
 	}
-	writeJSON(w, map[string]any{"task": t}, http.StatusOK)
-}
-
-func (app *application) getTasksHandler(w http.ResponseWriter, r *http.Request) {
-	user := getUserFromRequest(r)
-	if user == nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	if !checkIfMatch(w, r, t.Version) {
 		return
 	}
 
-	query := r.URL.Query()
-	sort := query.Get("sort")
-	if sort == "" {
-		sort = "id"
+	var input struct {
+		ID          int        `json:"id"`
+		CreatedAt   time.Time  `json:"created_at"`
+		UserID      int        `json:"user_id"`
+		Content     *string    `json:"content"`
+		IsCompleted *bool      `json:"is_completed"`
+		CompletedAt *time.Time `json:"completed_at"`
+		UpdatedAt   time.Time  `json:"updated_at"`
+	}
+	ok := app.readPatch(w, r, t, &input)
+	if !ok {
+		return
 	}
 
-	page := 1
-	pageSize := 20
-
-	pageStr := query.Get("page")
-	if pageStr != "" {
-		p, err := strconv.Atoi(pageStr)
-		if err != nil || p <= 0 {
-			writeError(w, errors.New(`invalid query parameter "page": must be a positive integer`), http.StatusBadRequest)
-			return
-		}
-		page = p
-	}
-	pageSizeStr := query.Get("page_size")
-	if pageSizeStr != "" {
-		size, err := strconv.Atoi(pageSizeStr)
-		if err != nil || size <= 0 {
-			writeError(w, errors.New(`invalid query param "page_size": must be a positive integer`), http.StatusBadRequest)
-			return
-		}
-		pageSize = size
+	v := newValidator()
+	v.checkCond(input.ID == t.ID, "id", "is read-only")
+	v.checkCond(input.CreatedAt.Equal(t.CreatedAt), "created_at", "is read-only")
+	v.checkCond(input.UserID == t.UserID, "user_id", "is read-only")
+	v.checkCond(sameTime(input.CompletedAt, t.CompletedAt), "completed_at", "is read-only")
+	v.checkCond(input.UpdatedAt.Equal(t.UpdatedAt), "updated_at", "is read-only")
+	v.checkCond(input.Content != nil, "content", "must not be removed")
+	v.checkCond(input.IsCompleted != nil, "is_completed", "must not be removed")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemInvalidPatchResult, v)
+		return
 	}
+	app.saveTask(w, r, t, *input.Content, *input.IsCompleted)
+}
 
+// saveTask validates and persists a full replacement of the task's content and
+// completion state.
+func (app *application) saveTask(w http.ResponseWriter, r *http.Request, t *task, content string, isCompleted bool) {
 	v := newValidator()
-	sortList := []string{"id", "-id", "created_at", "-created_at", "is_completed", "-is_completed"}
-	v.checkCond(slices.Index(sortList, sort) != -1, "sort", fmt.Sprintf("must be one of the values %v", sortList))
-	v.checkCond(page >= 1 && page <= 10_000_000, "page", "must be between 1 and 10_000_000")
-	v.checkCond(pageSize >= 1 && page <= 100, "page_size", "must be between 1 and 100")
-
-	content := query.Get("content")
-
-	tasks, total, err := app.storage.getTasksForUser(user, sort, page, pageSize, content)
-	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	v.checkCond(content != "", "content", "must not be empty")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
 		return
 	}
-	if tasks == nil {
-		writeError(w, errors.New("resource doesn't exist"), http.StatusNotFound)
+
+	t.Content = content
+	t.IsCompleted = isCompleted
+	err := app.storageFor(r).updateTask(t)
+	if err != nil {
+		switch {
+		case errors.Is(err, errEditConflict):
+			app.writeTaskConflict(w, r, t.ID)
+		default:
+			writeError(w, r, problemInternal, "")
+		}
 		return
 	}
-	writeJSON(w, map[string]any{"tasks": tasks, "total": total}, http.StatusOK)
+	w.Header().Set("ETag", composeETag(t.Version))
+	writeResponse(w, r, map[string]any{"task": t}, http.StatusOK)
 }
 
-func (app *application) deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) getTaskHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil || id < -1 {
-		writeError(w, errors.New("route paramter {id}: must to be a positive integer"), http.StatusBadRequest)
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	query := r.URL.Query()
+	v := newValidator()
+	fields := readList(query, "fields", taskFieldList, v)
+	expand := readList(query, "expand", taskExpandList, v)
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
 		return
 	}
 
 	user := getUserFromRequest(r)
 	if user == nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
-	t, err := app.storage.getTaskByID(id)
+	t, err := app.storageFor(r).getTaskByID(id, fields...)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
 	if t == nil {
-		writeError(w, errors.New("resource doesn't exist"), http.StatusNotFound)
+		writeError(w, r, problemTaskNotFound, "")
 		return
 	}
 	if t.UserID != user.ID {
-		writeError(w, errors.New("access denied"), http.StatusConflict)
+		writeError(w, r, problemAccessDenied, "")
+		return
+	}
+	if conditionalTaskRead(expand) && checkNotModified(w, r, composeETag(t.Version), t.UpdatedAt) {
 		return
 	}
-	err = app.storage.deleteTask(t)
+	resp, err := app.composeTasksResponse(r, user, []task{*t}, fields, expand)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
 		return
 	}
-	writeJSON(w, map[string]any{"message": "task deleted successfully"}, http.StatusOK)
+	resp["task"] = resp["tasks"].([]map[string]any)[0]
+	delete(resp, "tasks")
+	w.Header().Set("ETag", composeETag(t.Version))
+	writeResponse(w, r, resp, http.StatusOK)
 }
 
-func (app *application) sendActivationCodeHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil || id < -1 {
-		writeError(w, errors.New("route paramter {id}: must to be a positive integer"), http.StatusBadRequest)
+func (app *application) getTasksHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
-	u, err := app.storage.getUserByID(id)
-	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	query := r.URL.Query()
+	v := newValidator()
+	filter := readTaskFilter(query, v)
+	page, pageSize := readPagination(query, v)
+	fields := readList(query, "fields", taskFieldList, v)
+	expand := readList(query, "expand", taskExpandList, v)
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
 		return
 	}
 
-	if u.IsActivated {
-		writeJSON(w, map[string]any{"message": "user already activated"}, http.StatusConflict)
+	count, versions, lastModified, err := app.storageFor(r).getTasksStateForUser(user, filter)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	etag := composeListETag(user, count, versions, lastModified, query)
+	// deletions don't advance the latest modification, so the list is only
+	// validated by its ETag and gets no Last-Modified
+	if conditionalTaskRead(expand) && checkNotModified(w, r, etag, time.Time{}) {
 		return
 	}
 
-	if app.storage.useractivationCache.HasExpired(u) {
-		tmpl, err := template.ParseFS(templates, "templates/*.gotmpl")
-		if err != nil {
-			writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
-			return
-		}
-		code := uint16(rand.Uint())
-		err = app.mailer.send(u.Email, tmpl, map[string]any{"code": code})
-		if err != nil {
-			log.Println(err)
-			writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
-			return
-		}
-		app.storage.useractivationCache.Set(u, code, time.Minute)
+	tasks, total, err := app.storageFor(r).getTasksForUser(user, filter, page, pageSize, fields...)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if tasks == nil {
+		writeError(w, r, problemTaskNotFound, "")
+		return
+	}
+	resp, err := app.composeTasksResponse(r, user, tasks, fields, expand)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
 	}
-	writeJSON(w, map[string]any{"message": fmt.Sprintf("we have sent an activation code to your email: %s", u.Email)}, http.StatusOK)
+	resp["total"] = total
+	resp["metadata"] = writePagination(w, r, total, page, pageSize)
+	writeResponse(w, r, resp, http.StatusOK)
 }
 
-func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil || id < -1 {
-		writeError(w, errors.New("route paramter {id}: must to be a positive integer"), http.StatusBadRequest)
+func (app *application) getTaskStatsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
-	var input struct {
-		Code *int `json:"code"`
+	query := r.URL.Query()
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+
+	v := newValidator()
+	v.checkCond(interval == "day" || interval == "week", "interval", "must be one of the values [day week]")
+	if t := readTime(query, "from", v); t != nil {
+		from = *t
+	}
+	if t := readTime(query, "to", v); t != nil {
+		to = *t
+	}
+	v.checkCond(from.Before(to), "from", "must be before to")
+	v.checkCond(to.Sub(from) <= 366*24*time.Hour, "to", "must be atmost 366 days after from")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
 	}
 
-	err = json.NewDecoder(r.Body).Decode(&input)
+	stats, err := app.storageFor(r).getTaskStats(user, interval, from, to)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
 		return
 	}
+	writeResponse(w, r, map[string]any{"stats": stats}, http.StatusOK)
+}
 
-	if input.Code == nil {
-		writeError(w, errors.New("code must be provided in request body"), http.StatusBadRequest)
+func (app *application) deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < -1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
 		return
 	}
 
-	u, err := app.storage.getUserByID(id)
+	t, err := app.storageFor(r).getTaskByID(id)
 	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
-	if u.IsActivated {
-		writeJSON(w, map[string]any{"message": "user already activated"}, http.StatusConflict)
+	if t == nil {
+		writeError(w, r, problemTaskNotFound, "")
 		return
 	}
-	activationCode, expired := app.storage.useractivationCache.Get(u)
-	if expired {
-		writeJSON(w, map[string]any{"message": "code has expired"}, http.StatusConflict)
+	if t.UserID != user.ID {
+		writeError(w, r, problemAccessDenied, "")
 		return
 	}
-	if activationCode != *input.Code {
-		writeJSON(w, map[string]any{"message": "invalid activation code"}, http.StatusConflict)
+	if !checkIfMatch(w, r, t.Version) {
 		return
 	}
-	u.IsActivated = true
-	err = app.storage.updateUser(u)
+	err = app.storageFor(r).deleteTask(t)
 	if err != nil {
-		log.Println(err)
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, errEditConflict):
+			app.writeTaskConflict(w, r, t.ID)
+		default:
+			writeError(w, r, problemInternal, "")
+		}
 		return
 	}
-	writeJSON(w, map[string]any{"user": u}, http.StatusOK)
+	writeResponse(w, r, map[string]any{"message": "task deleted successfully"}, http.StatusOK)
 }
 
-func (app *application) authenticateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&input)
-	if err != nil {
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+func (app *application) createFilterHandler(w http.ResponseWriter, r *http.Request) {
+	var input createFilterInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
 		return
 	}
 
 	v := newValidator()
-	v.checkEmail(input.Email)
-	v.checkPassword(input.Password)
-
+	v.checkCond(input.Name != "", "name", "must be provided")
+	v.checkCond(len(input.Name) <= 255, "name", "must be atmost 255 characters")
+	v.checkTaskFilter(input.Filter)
 	if v.hasErrors() {
-		writeError(w, v.toError(), http.StatusBadRequest)
+		writeValidationError(w, r, problemValidationFailed, v)
 		return
 	}
 
-	u, err := app.storage.getUserByEmail(input.Email)
-	if err != nil {
-		log.Println(err)
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
 		return
 	}
-
-	if u == nil {
-		writeError(w, errors.New("email or password are not correct"), http.StatusUnauthorized)
-		return
+	f := &savedFilter{
+		UserID: user.ID,
+		Name:   input.Name,
+		Filter: input.Filter,
 	}
-
-	err = bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(input.Password))
+	err := app.storageFor(r).insertFilter(user, f)
 	if err != nil {
-		writeError(w, errors.New("email or password are not correct"), http.StatusUnauthorized)
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
 		return
 	}
+	writeResponse(w, r, map[string]any{"filter": f}, http.StatusCreated)
+}
 
-	claims := jwt.MapClaims{
-		"user_id":    u.ID,
-		"expires_at": time.Now().Add(24 * time.Hour).Format(time.RFC822),
+func (app *application) getFiltersHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenStr, err := token.SignedString([]byte(app.config.jwt.secret))
+
+	filters, err := app.storageFor(r).getFiltersForUser(user)
 	if err != nil {
 		log.Println(err)
-		writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+		writeError(w, r, problemInternal, "")
 		return
 	}
-	writeJSON(w, map[string]any{"token": tokenStr}, http.StatusCreated)
+	if r.URL.Query().Get("with_counts") == "true" {
+		for i := range filters {
+			count, err := app.storageFor(r).countTasksForUserSince(user, filters[i].Filter, filters[i].LastViewedAt)
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, problemInternal, "")
+				return
+			}
+			filters[i].NewCount = &count
+		}
+	}
+	writeResponse(w, r, map[string]any{"filters": filters}, http.StatusOK)
 }
 
-func composeJSONError(err error) string {
-	jsonError := map[string]string{
-		"error": err.Error(),
-	}
-	result, err := json.Marshal(jsonError)
-	if err != nil {
+func (app *application) getFilterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < -1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+
+	f, err := app.storageFor(r).getFilterByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if f == nil {
+		writeError(w, r, problemFilterNotFound, "")
+		return
+	}
+	if f.UserID != user.ID {
+		writeError(w, r, problemAccessDenied, "")
+		return
+	}
+	if r.URL.Query().Get("with_counts") == "true" {
+		count, err := app.storageFor(r).countTasksForUserSince(user, f.Filter, f.LastViewedAt)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		f.NewCount = &count
+	}
+	writeResponse(w, r, map[string]any{"filter": f}, http.StatusOK)
+}
+
+func (app *application) updateFilterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < -1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	var input updateFilterInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	if input.Name != nil {
+		v.checkCond(*input.Name != "", "name", "must not be empty")
+		v.checkCond(len(*input.Name) <= 255, "name", "must be atmost 255 characters")
+	}
+	if input.Filter != nil {
+		v.checkTaskFilter(*input.Filter)
+	}
+	v.checkCond(input.Name != nil || input.Filter != nil, "name or filter", "must be provided")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+
+	f, err := app.storageFor(r).getFilterByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if f == nil {
+		writeError(w, r, problemFilterNotFound, "")
+		return
+	}
+	if f.UserID != user.ID {
+		writeError(w, r, problemAccessDenied, "")
+		return
+	}
+	if input.Name != nil {
+		f.Name = *input.Name
+	}
+	if input.Filter != nil {
+		f.Filter = *input.Filter
+	}
+	err = app.storageFor(r).updateFilter(f)
+	if err != nil {
+		switch {
+		case errors.Is(err, errEditConflict):
+			writeError(w, r, problemEditConflict, "the filter was modified concurrently")
+		default:
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+		}
+		return
+	}
+	writeResponse(w, r, map[string]any{"filter": f}, http.StatusOK)
+}
+
+func (app *application) deleteFilterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < -1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+
+	f, err := app.storageFor(r).getFilterByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if f == nil {
+		writeError(w, r, problemFilterNotFound, "")
+		return
+	}
+	if f.UserID != user.ID {
+		writeError(w, r, problemAccessDenied, "")
+		return
+	}
+	err = app.storageFor(r).deleteFilter(f)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "filter deleted successfully"}, http.StatusOK)
+}
+
+func (app *application) getFilterTasksHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < -1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	v := newValidator()
+	page, pageSize := readPagination(r.URL.Query(), v)
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	user := getUserFromRequest(r)
+	if user == nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+
+	f, err := app.storageFor(r).getFilterByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if f == nil {
+		writeError(w, r, problemFilterNotFound, "")
+		return
+	}
+	if f.UserID != user.ID {
+		writeError(w, r, problemAccessDenied, "")
+		return
+	}
+
+	tasks, total, err := app.storageFor(r).getTasksForUser(user, f.Filter, page, pageSize)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+
+	// viewing the results resets the filter's new count
+	err = app.storageFor(r).touchFilter(f)
+	if err != nil {
 		log.Println(err)
-		return ""
+		writeError(w, r, problemInternal, "")
+		return
 	}
-	return string(result)
+	metadata := writePagination(w, r, total, page, pageSize)
+	writeResponse(w, r, map[string]any{"tasks": tasks, "total": total, "metadata": metadata}, http.StatusOK)
 }
 
-func writeError(w http.ResponseWriter, err error, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	fmt.Fprintln(w, composeJSONError(err))
+func (app *application) sendActivationCodeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < -1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	u, err := app.storageFor(r).getUserByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u == nil {
+		writeError(w, r, problemUserNotFound, "")
+		return
+	}
+
+	if u.IsActivated {
+		writeError(w, r, problemUserAlreadyActivated, "")
+		return
+	}
+	// a new code would reset the wrong attempts left on the current one
+	if app.throttled(w, r, activationAttemptKey(u)) {
+		return
+	}
+
+	if app.storageFor(r).useractivationCache.HasExpired(u) {
+		tmpl, err := template.ParseFS(templates, "templates/user_activation.gotmpl")
+		if err != nil {
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		code := uint16(rand.Uint())
+		err = app.mailer.send(u.Email, tmpl, map[string]any{"code": code})
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		app.storageFor(r).useractivationCache.Set(u, code, time.Minute)
+	}
+	writeResponse(w, r, map[string]any{"message": fmt.Sprintf("we have sent an activation code to your email: %s", u.Email)}, http.StatusOK)
+}
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < -1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+
+	var input activateUserInput
+
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	if input.Code == nil {
+		writeError(w, r, problemActivationCodeRequired, "code must be provided in request body")
+		return
+	}
+	if app.throttled(w, r, ipAttemptKey(r)) {
+		return
+	}
+
+	u, err := app.storageFor(r).getUserByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u == nil {
+		writeError(w, r, problemUserNotFound, "")
+		return
+	}
+	if u.IsActivated {
+		writeError(w, r, problemUserAlreadyActivated, "")
+		return
+	}
+	if app.throttled(w, r, activationAttemptKey(u)) {
+		return
+	}
+	activationCode, expired := app.storageFor(r).useractivationCache.Get(u)
+	if expired {
+		writeError(w, r, problemActivationCodeExpired, "")
+		return
+	}
+	if subtle.ConstantTimeEq(int32(activationCode), int32(*input.Code)) != 1 {
+		err = app.recordFailedAttempt(nil, activationAttemptKey(u), ipAttemptKey(r))
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		left := app.storageFor(r).useractivationCache.Fail(u)
+		if left == 0 {
+			writeError(w, r, problemActivationCodeExpired, "too many wrong codes, request a new activation code")
+			return
+		}
+		writeError(w, r, problemInvalidActivationCode, fmt.Sprintf("%d attempts left", left))
+		return
+	}
+	u.IsActivated = true
+	// tokens issued before the activation stop being accepted
+	u.CredentialVersion++
+	err = app.storageFor(r).updateUser(u)
+	if err != nil {
+		switch {
+		case errors.Is(err, errEditConflict):
+			app.writeUserConflict(w, r, u.ID)
+		default:
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+		}
+		return
+	}
+	err = app.storageFor(r).deleteSessionsForUser(u)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	w.Header().Set("ETag", composeETag(u.Version))
+	writeResponse(w, r, map[string]any{"user": u}, http.StatusOK)
+}
+
+// requestPasswordResetHandler emails a password reset token to the user. It
+// responds the same whether the email belongs to a user or not, and sends the
+// email in the background so the response time doesn't tell either.
+func (app *application) requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var input requestPasswordResetInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkEmail(input.Email)
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	u, err := app.storageFor(r).getUserByEmail(input.Email)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u != nil {
+		token, err := randomToken()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		// the email goes out whatever becomes of a batch the request is part of,
+		// so the token is stored outside of its transaction
+		hash := sha256.Sum256([]byte(token))
+		err = app.storage.insertPasswordResetToken(&passwordResetToken{
+			Hash:      hash[:],
+			UserID:    u.ID,
+			ExpiresAt: time.Now().Add(passwordResetTokenTTL),
+		})
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		go func() {
+			err := app.sendPasswordReset(u, token)
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	writeResponse(w, r, map[string]any{"message": "if the email belongs to an account, a password reset token was sent to it"}, http.StatusAccepted)
+}
+
+func (app *application) sendPasswordReset(u *user, token string) error {
+	tmpl, err := template.ParseFS(templates, "templates/user_password_reset.gotmpl")
+	if err != nil {
+		return err
+	}
+	return app.mailer.send(u.Email, tmpl, map[string]any{"token": token})
+}
+
+var errInvalidPasswordReset = errors.New("invalid password reset token")
+
+// resetPasswordHandler sets the password of the user the reset token was sent
+// to and signs the user out everywhere.
+func (app *application) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input resetPasswordInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkCond(input.Token != "", "token", "must be provided")
+	v.checkPassword(input.Password)
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	hash := sha256.Sum256([]byte(input.Token))
+	var u *user
+	// the token is only used up together with the reset, a failure leaves it
+	// for another attempt
+	err := app.inTx(r, func(r *http.Request) error {
+		t, err := app.storageFor(r).usePasswordResetToken(hash[:])
+		if err != nil {
+			return err
+		}
+		if t == nil || time.Now().After(t.ExpiresAt) {
+			return errInvalidPasswordReset
+		}
+		u, err = app.storageFor(r).getUserByID(t.UserID)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			return errInvalidPasswordReset
+		}
+
+		u.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(input.Password), 13)
+		if err != nil {
+			return err
+		}
+		// tokens issued before the reset stop being accepted
+		u.CredentialVersion++
+		err = app.storageFor(r).updateUser(u)
+		if err != nil {
+			return err
+		}
+		err = app.storageFor(r).deleteSessionsForUser(u)
+		if err != nil {
+			return err
+		}
+		err = app.storageFor(r).deletePersonalAccessTokensForUser(u)
+		if err != nil {
+			return err
+		}
+		return app.storageFor(r).deletePasswordResetTokensForUser(u)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidPasswordReset):
+			writeError(w, r, problemInvalidPasswordReset, "")
+		case errors.Is(err, errEditConflict):
+			app.writeUserConflict(w, r, u.ID)
+		default:
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+		}
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "password reset, every session and personal access token was revoked"}, http.StatusOK)
+}
+
+func (app *application) authenticateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input authenticateUserInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkEmail(input.Email)
+	v.checkPassword(input.Password)
+	v.checkCond(len(input.DeviceName) <= 255, "device_name", "must be atmost 255 characters long")
+
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	account := accountAttemptKey(input.Email)
+	if app.throttled(w, r, account, ipAttemptKey(r)) {
+		return
+	}
+
+	u, err := app.storageFor(r).getUserByEmail(input.Email)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+
+	hash := dummyPasswordHash()
+	if u != nil {
+		hash = u.PasswordHash
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(input.Password))
+	if u == nil || err != nil {
+		err = app.recordFailedAttempt(u, account, ipAttemptKey(r))
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		writeError(w, r, problemInvalidCredentials, "")
+		return
+	}
+
+	app.signIn(w, r, u, input.DeviceName)
 }
 
-func writeJSON(w http.ResponseWriter, data any, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
+// signIn responds with the tokens of a new session for the user whose first
+// factor was verified, or with an MFA challenge if the user has two-factor
+// authentication enabled. Failed attempts are only forgotten once the tokens
+// are issued, otherwise signing in with the password again would reset the
+// count of wrong MFA codes.
+func (app *application) signIn(w http.ResponseWriter, r *http.Request, u *user, deviceName string) {
+	c, err := app.storageFor(r).getTOTPCredential(u.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if c != nil && c.ConfirmedAt != nil {
+		ch, err := app.issueMFAChallenge(u, deviceName)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		writeResponse(w, r, ch, http.StatusAccepted)
+		return
+	}
+	err = app.storage.deleteAuthFailures(accountAttemptKey(u.Email).key)
+	if err != nil {
+		log.Println(err)
+	}
+
+	se, err := app.startSession(r, u, deviceName)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	tokens, err := app.issueTokens(r, u, se.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, tokens, http.StatusCreated)
+}
+
+func (app *application) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var input batchInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkCond(len(input.Requests) != 0, "requests", "must be provided")
+	v.checkCond(len(input.Requests) <= 20, "requests", "must contain atmost 20 requests")
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	for i, req := range input.Requests {
+		key := fmt.Sprintf("requests[%d]", i)
+		v.checkCond(slices.Contains(methods, req.Method), key+".method", fmt.Sprintf("must be one of the values %v", methods))
+		version, rest, _ := strings.Cut(strings.TrimPrefix(req.Path, "/"), "/")
+		v.checkCond(slices.ContainsFunc(app.apiVersions(), func(av apiVersion) bool { return av.name == version }), key+".path", "must start with an API version prefix such as \"/v1/\"")
+		v.checkCond(!strings.HasPrefix(rest, "batch"), key+".path", "batch requests can't be nested")
+		// a reused refresh token revokes its session, which a rolled back batch
+		// would undo, and the revocation would wait on the rows the batch holds
+		route, _, _ := strings.Cut(rest, "?")
+		v.checkCond(!input.Atomic || route != "tokens/refresh", key+".path", "refresh tokens can't be rotated in atomic batches")
+	}
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	// the batch was charged a single rate limit token on the way in, it exists
+	// to bundle a burst of requests so its sub-requests aren't charged again.
+	// Those of atomic batches carry the storage bound to the batch's transaction.
+	ctx := r.Context()
+	var txStorage *storage
+	if input.Atomic {
+		tx, err := app.storage.beginTx(ctx)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		defer tx.Rollback()
+		txStorage = app.storage.withTx(tx)
+		ctx = context.WithValue(ctx, storageContextKey, txStorage)
+	}
+
+	responses := make([]batchResponse, 0, len(input.Requests))
+	failed := false
+	for _, req := range input.Requests {
+		sub, err := http.NewRequestWithContext(ctx, req.Method, req.Path, bytes.NewReader(req.Body))
+		if err != nil {
+			writeError(w, r, problemMalformedRequest, err.Error())
+			return
+		}
+		sub.RemoteAddr = r.RemoteAddr
+		sub.Header.Set("Content-Type", "application/json")
+		sub.Header.Set("Accept", "application/json")
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			sub.Header.Set("Authorization", auth)
+		}
+		for k, v := range req.Headers {
+			sub.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		app.mux.ServeHTTP(rec, sub)
+
+		body := bytes.TrimSpace(rec.Body.Bytes())
+		if len(body) == 0 {
+			body = []byte("null")
+		} else if !json.Valid(body) {
+			body, _ = json.Marshal(string(body))
+		}
+		// credentials handed out by a sub-request keep the batch from being stored
+		if strings.Contains(rec.Header().Get("Cache-Control"), "no-store") {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		responses = append(responses, batchResponse{
+			Status:  rec.Code,
+			Headers: rec.Header(),
+			Body:    body,
+		})
+		if rec.Code >= 400 && input.Atomic {
+			failed = true
+			break
+		}
+	}
+
+	if input.Atomic {
+		if failed {
+			writeResponse(w, r, map[string]any{"responses": responses, "committed": false}, http.StatusOK)
+			return
+		}
+		err := txStorage.commit()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+	}
+	writeResponse(w, r, map[string]any{"responses": responses, "committed": true}, http.StatusOK)
+}
+
+// readRequest decodes a single value from the request body into dst, it
+// writes a response describing the problem and returns false when the body is
+// too large, malformed, has unknown fields or is sent in an unsupported format.
+func (app *application) readRequest(w http.ResponseWriter, r *http.Request, dst any) bool {
+	c := codecFor(r.Header.Get("Content-Type"))
+	if c == nil {
+		w.Header().Set("Accept", strings.Join(supportedMediaTypes(), ", "))
+		writeError(w, r, problemUnsupportedMediaType, "Content-Type must be one of "+strings.Join(supportedMediaTypes(), ", "))
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.maxBodyBytes)
+	if c != jsonCodec {
+		body, ok := app.readBody(w, r)
+		if !ok {
+			return false
+		}
+		body, err := c.toJSON(body)
+		if err != nil {
+			writeError(w, r, problemMalformedRequest, fmt.Sprintf("body contains badly-formed %s: %v", c.mediaType, err))
+			return false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(dst)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &syntaxError):
+			writeError(w, r, problemMalformedRequest, fmt.Sprintf("body contains badly-formed JSON (at character %d)", syntaxError.Offset))
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			writeError(w, r, problemMalformedRequest, "body contains badly-formed JSON")
+		case errors.As(err, &unmarshalTypeError):
+			field := unmarshalTypeError.Field
+			if field == "" {
+				writeError(w, r, problemMalformedRequest, fmt.Sprintf("body must be a JSON %s", describeJSONType(dst)))
+				return false
+			}
+			p := newProblem(r, problemMalformedRequest, fmt.Sprintf("body contains incorrect JSON type for field %q", field))
+			p.Errors = []fieldViolation{{Field: field, Message: fmt.Sprintf("must be a JSON %s", unmarshalTypeError.Type.Kind())}}
+			writeProblem(w, r, p)
+		case errors.Is(err, io.EOF):
+			writeError(w, r, problemMalformedRequest, "body must not be empty")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			p := newProblem(r, problemMalformedRequest, fmt.Sprintf("body contains unknown field %q", field))
+			p.Errors = []fieldViolation{{Field: field, Message: "is not a known field"}}
+			writeProblem(w, r, p)
+		case errors.As(err, &maxBytesError):
+			writeError(w, r, problemBodyTooLarge, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+		}
+		return false
+	}
+
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		writeError(w, r, problemMalformedRequest, "body must only contain a single JSON value")
+		return false
+	}
+	return true
+}
+
+func describeJSONType(dst any) string {
+	switch reflect.Indirect(reflect.ValueOf(dst)).Kind() {
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	default:
+		return "value"
+	}
+}
+
+// readBody reads the whole request body up to the configured size limit, it
+// writes the error response and returns false on failure.
+func (app *application) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, app.config.maxBodyBytes))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			writeError(w, r, problemBodyTooLarge, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			writeError(w, r, problemMalformedRequest, err.Error())
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// readPatch applies the request's patch document to the JSON representation of
+// current and decodes the result into dst, it writes the error response and
+// returns false on failure.
+func (app *application) readPatch(w http.ResponseWriter, r *http.Request, current any, dst any) bool {
+	body, ok := app.readBody(w, r)
+	if !ok {
+		return false
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return false
+	}
+	patched, err := applyPatch(r.Header.Get("Content-Type"), doc, body)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedPatchType):
+			w.Header().Set("Accept-Patch", acceptPatch)
+			writeError(w, r, problemUnsupportedPatchType, "supported media types are "+acceptPatch)
+		case errors.Is(err, errPatchTestFailed):
+			writeError(w, r, problemPatchTestFailed, err.Error())
+		default:
+			writeError(w, r, problemInvalidPatch, err.Error())
+		}
+		return false
+	}
+	// the patched document is decoded as strictly as a PUT body, so patches of
+	// members that don't exist fail instead of silently changing nothing
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(dst)
+	if err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			field = strings.Trim(field, `"`)
+			p := newProblem(r, problemInvalidPatchResult, fmt.Sprintf("patched document contains unknown member %q", field))
+			p.Errors = []fieldViolation{{Field: field, Message: "is not a known field"}}
+			writeProblem(w, r, p)
+			return false
+		}
+		writeError(w, r, problemInvalidPatchResult, err.Error())
+		return false
+	}
+	return true
+}
+
+// sameTime reports whether two optional times are both unset or equal.
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func readTaskFilter(query url.Values, v *validator) taskFilter {
+	f := taskFilter{
+		Content: query.Get("content"),
+		Sort:    query.Get("sort"),
+	}
+
+	isCompletedStr := query.Get("is_completed")
+	if isCompletedStr != "" {
+		isCompleted, err := strconv.ParseBool(isCompletedStr)
+		v.checkCond(err == nil, "is_completed", "must be either true or false")
+		f.IsCompleted = &isCompleted
+	}
+
+	f.CreatedAfter = readTime(query, "created_after", v)
+	f.CreatedBefore = readTime(query, "created_before", v)
+
+	idsStr := query.Get("ids")
+	if idsStr != "" {
+		for _, s := range strings.Split(idsStr, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			v.checkCond(err == nil, "ids", "must be a comma separated list of positive integers")
+			f.IDs = append(f.IDs, id)
+		}
+	}
+
+	v.checkTaskFilter(f)
+	return f
+}
+
+func readList(query url.Values, key string, allowed []string, v *validator) []string {
+	s := query.Get(key)
+	if s == "" {
+		return nil
+	}
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		v.checkCond(slices.Contains(allowed, item), key, fmt.Sprintf("must be a comma separated list of the values %v", allowed))
+		list = append(list, item)
+	}
+	return list
+}
+
+func readTime(query url.Values, key string, v *validator) *time.Time {
+	s := query.Get(key)
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, s)
+	}
+	v.checkCond(err == nil, key, "must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	return &t
+}
+
+// composeTasksResponse projects tasks down to the requested fields and embeds
+// the requested expansions, the tasks are returned under the "tasks" key.
+func (app *application) composeTasksResponse(r *http.Request, u *user, tasks []task, fields, expand []string) (map[string]any, error) {
+	projected := make([]map[string]any, 0, len(tasks))
+	for i := range tasks {
+		m, err := project(&tasks[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(expand, "owner") {
+			m["owner"] = u
+		}
+		projected = append(projected, m)
+	}
+	resp := map[string]any{"tasks": projected}
+	if slices.Contains(expand, "counts") {
+		open, completed, err := app.storageFor(r).countTasksByState(u)
+		if err != nil {
+			return nil, err
+		}
+		resp["counts"] = taskCounts{Open: open, Completed: completed, Total: open + completed}
+	}
+	return resp, nil
+}
+
+// project keeps only the given top-level fields of data's JSON representation,
+// all fields are kept when none are given.
+func project(data any, fields []string) (map[string]any, error) {
 	j, err := json.Marshal(data)
 	if err != nil {
-		writeError(w, err, http.StatusInternalServerError)
+		return nil, err
+	}
+	var m map[string]any
+	err = json.Unmarshal(j, &m)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return m, nil
+	}
+	for k := range m {
+		if !slices.Contains(fields, k) {
+			delete(m, k)
+		}
+	}
+	return m, nil
+}
+
+func composeETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// composeListETag derives a weak ETag for a page of results from the number of
+// matching rows, the sum of their versions, their latest modification and the
+// query that selected them.
+func composeListETag(u *user, count, versions int, lastModified time.Time, query url.Values) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%d|%d|%d|%s", u.ID, count, versions, lastModified.UnixNano(), query.Encode())))
+	return fmt.Sprintf(`W/"%s"`, hex.EncodeToString(sum[:16]))
+}
+
+// conditionalTaskRead reports whether a task read can be validated by the
+// tasks alone. Counts depend on other tasks and the owner on the user, the
+// validators of the tasks don't change with them.
+func conditionalTaskRead(expand []string) bool {
+	return !slices.Contains(expand, "counts") && !slices.Contains(expand, "owner")
+}
+
+// checkNotModified sets the ETag and Last-Modified validators on the response and
+// reports whether the request's If-None-Match or If-Modified-Since precondition
+// matched them, in which case a 304 has been written.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" {
+		// If-None-Match uses the weak comparison
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince := r.Header.Get("If-Modified-Since")
+	if ifModifiedSince != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch reports whether the request's If-Match precondition holds for the
+// given resource version, it writes a 412 response when it doesn't.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	etag := composeETag(version)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		// If-Match uses the strong comparison so weak tags never match
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	w.Header().Set("ETag", etag)
+	writeError(w, r, problemPreconditionFailed, "the resource has been modified since it was fetched")
+	return false
+}
+
+// writeTaskConflict responds to a lost update race with the task's current
+// representation so the client can reconcile and retry.
+func (app *application) writeTaskConflict(w http.ResponseWriter, r *http.Request, id int) {
+	t, err := app.storageFor(r).getTaskByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if t == nil {
+		writeError(w, r, problemTaskNotFound, "")
+		return
+	}
+	w.Header().Set("ETag", composeETag(t.Version))
+	p := newProblem(r, problemEditConflict, "the task was modified concurrently")
+	p.Extensions = map[string]any{"task": t}
+	writeProblem(w, r, p)
+}
+
+// writeUserConflict is the user counterpart of writeTaskConflict.
+func (app *application) writeUserConflict(w http.ResponseWriter, r *http.Request, id int) {
+	u, err := app.storageFor(r).getUserByID(id)
+	if err != nil {
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u == nil {
+		writeError(w, r, problemUserNotFound, "")
+		return
+	}
+	w.Header().Set("ETag", composeETag(u.Version))
+	p := newProblem(r, problemEditConflict, "the user was modified concurrently")
+	p.Extensions = map[string]any{"user": u}
+	writeProblem(w, r, p)
+}
+
+// writeResponse encodes data in the format negotiated from the Accept header,
+// JSON is used when the request isn't available.
+func writeResponse(w http.ResponseWriter, r *http.Request, data any, statusCode int) {
+	c := negotiate(r)
+	if c == nil {
+		c = jsonCodec
+	}
+	body, err := c.encode(data)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
 		return
 	}
+	w.Header().Set("Content-Type", c.mediaType)
+	w.Header().Add("Vary", "Accept")
 	w.WriteHeader(statusCode)
-	w.Write(j)
+	w.Write(body)
 }
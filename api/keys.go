@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is a key of the key ring, keys without a private part only verify
+// tokens. This is how a rotated out key stays trusted until the tokens it
+// signed have expired.
+type jwtKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// keyRing signs tokens with its signing key and verifies them with any of its
+// keys, picked by the kid header.
+type keyRing struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+}
+
+// loadKeyRing reads every <kid>.pem file of dir. Files may hold an Ed25519,
+// P-256 or RSA private key, or only a public key. signingKeyID selects the
+// signing key and may be empty when the directory holds a single private key.
+func loadKeyRing(dir, signingKeyID string) (*keyRing, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := &keyRing{keys: make(map[string]*jwtKey)}
+	var private []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".pem" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		k, err := parseJWTKey(strings.TrimSuffix(e.Name(), ".pem"), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		ring.keys[k.id] = k
+		if k.private != nil {
+			private = append(private, k.id)
+		}
+	}
+
+	switch {
+	case signingKeyID != "":
+		ring.signing = ring.keys[signingKeyID]
+		if ring.signing == nil || ring.signing.private == nil {
+			return nil, fmt.Errorf("no private key with the id %q in %s", signingKeyID, dir)
+		}
+	case len(private) == 1:
+		ring.signing = ring.keys[private[0]]
+	default:
+		return nil, fmt.Errorf("%s holds %d private keys, the signing key id must be set", dir, len(private))
+	}
+	return ring, nil
+}
+
+// newEphemeralKeyRing generates an Ed25519 key that only lives as long as the
+// process, tokens don't survive a restart and aren't accepted by other
+// instances.
+func newEphemeralKeyRing() (*keyRing, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	k, err := newJWTKey(id, private)
+	if err != nil {
+		return nil, err
+	}
+	return &keyRing{signing: k, keys: map[string]*jwtKey{k.id: k}}, nil
+}
+
+func parseJWTKey(id string, data []byte) (*jwtKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newJWTKey(id, key)
+}
+
+func newJWTKey(id string, key any) (*jwtKey, error) {
+	k := &jwtKey{id: id}
+	if signer, ok := key.(crypto.Signer); ok {
+		k.private = signer
+		key = signer.Public()
+	}
+	k.public = key
+
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		k.method = jwt.SigningMethodES256
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits long")
+		}
+		k.method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return k, nil
+}
+
+func (ring *keyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ring.signing.method, claims)
+	token.Header["kid"] = ring.signing.id
+	return token.SignedString(ring.signing.private)
+}
+
+func (ring *keyRing) methods() []string {
+	var methods []string
+	for _, k := range ring.keys {
+		if !slices.Contains(methods, k.method.Alg()) {
+			methods = append(methods, k.method.Alg())
+		}
+	}
+	return methods
+}
+
+// keyFunc resolves the verification key of a token from its kid header, the
+// algorithm must be the one of the key.
+func (ring *keyRing) keyFunc(t *jwt.Token) (any, error) {
+	id, _ := t.Header["kid"].(string)
+	k, ok := ring.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", id)
+	}
+	if t.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", t.Method.Alg(), id)
+	}
+	return k.public, nil
+}
+
+// jwks returns the public keys as an RFC 7517 JSON Web Key Set.
+func (ring *keyRing) jwks() map[string]any {
+	ids := make([]string, 0, len(ring.keys))
+	for id := range ring.keys {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	enc := base64.RawURLEncoding.EncodeToString
+	keys := make([]map[string]any, 0, len(ids))
+	for _, id := range ids {
+		k := ring.keys[id]
+		jwk := map[string]any{
+			"kid": k.id,
+			"use": "sig",
+			"alg": k.method.Alg(),
+		}
+		switch pub := k.public.(type) {
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = enc(pub)
+		case *ecdsa.PublicKey:
+			jwk["kty"] = "EC"
+			jwk["crv"] = "P-256"
+			jwk["x"] = enc(pub.X.FillBytes(make([]byte, 32)))
+			jwk["y"] = enc(pub.Y.FillBytes(make([]byte, 32)))
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = enc(pub.N.Bytes())
+			jwk["e"] = enc(big.NewInt(int64(pub.E)).Bytes())
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]any{"keys": keys}
+}
+
+// getJWKSHandler publishes the verification keys so other services can check
+// access tokens without sharing a secret. It's always JSON, whatever the
+// request accepts, as JWKS clients expect.
+func (app *application) getJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := jsonCodec.encode(app.keys.jwks())
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(body)
+}
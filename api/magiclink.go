@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// requestMagicLinkHandler emails a single-use sign-in token to the user and
+// hands the requesting device the nonce the token must be verified with, so a
+// token read from the inbox on another device is of no use. The response is
+// the same whether the email belongs to a user or not.
+func (app *application) requestMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input requestMagicLinkInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkEmail(input.Email)
+	v.checkCond(len(input.DeviceName) <= 255, "device_name", "must be atmost 255 characters long")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	u, err := app.storageFor(r).getUserByEmail(input.Email)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u != nil {
+		token, err := randomToken()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		// the email goes out whatever becomes of a batch the request is part of,
+		// so the link is stored outside of its transaction
+		hash := sha256.Sum256([]byte(token))
+		nonceHash := sha256.Sum256([]byte(nonce))
+		err = app.storage.insertMagicLink(&magicLink{
+			Hash:       hash[:],
+			NonceHash:  nonceHash[:],
+			UserID:     u.ID,
+			DeviceName: input.DeviceName,
+			ExpiresAt:  time.Now().Add(magicLinkTTL),
+		})
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		go func() {
+			err := app.sendMagicLink(u, token)
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	writeResponse(w, r, map[string]any{
+		"nonce":   nonce,
+		"message": "if the email belongs to an account, a sign-in token was sent to it",
+	}, http.StatusAccepted)
+}
+
+func (app *application) sendMagicLink(u *user, token string) error {
+	tmpl, err := template.ParseFS(templates, "templates/user_magic_link.gotmpl")
+	if err != nil {
+		return err
+	}
+	return app.mailer.send(u.Email, tmpl, map[string]any{"token": token})
+}
+
+// verifyMagicLinkHandler signs the user in like authenticateUserHandler does.
+// The token is used up by the first attempt, even one with the wrong nonce.
+func (app *application) verifyMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input verifyMagicLinkInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkCond(input.Token != "", "token", "must be provided")
+	v.checkCond(input.Nonce != "", "nonce", "must be provided")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	hash := sha256.Sum256([]byte(input.Token))
+	l, err := app.storageFor(r).useMagicLink(hash[:])
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	nonceHash := sha256.Sum256([]byte(input.Nonce))
+	if l == nil || time.Now().After(l.ExpiresAt) || subtle.ConstantTimeCompare(l.NonceHash, nonceHash[:]) != 1 {
+		writeError(w, r, problemInvalidMagicLink, "")
+		return
+	}
+
+	u, err := app.storageFor(r).getUserByID(l.UserID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u == nil {
+		writeError(w, r, problemUnknownUser, "")
+		return
+	}
+	app.signIn(w, r, u, l.DeviceName)
+}
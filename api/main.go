@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/rand"
 	"flag"
 	"fmt"
 	"log"
@@ -15,9 +14,12 @@ import (
 const version = "1.0.0"
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port            int
+	env             string
+	maxBodyBytes    int64
+	validateOpenAPI bool
+	redocIntegrity  string
+	db              struct {
 		dsn                string
 		maxOpenConnections int
 		maxIdelConnections int
@@ -31,7 +33,14 @@ type config struct {
 		sender   string
 	}
 	jwt struct {
-		secret string
+		keyDir          string
+		ephemeral       bool
+		signingKeyID    string
+		issuer          string
+		audience        string
+		leeway          time.Duration
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
 	}
 	limiter struct {
 		maxRequestPerSecond float64
@@ -41,12 +50,24 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	versions struct {
+		v1Deprecation time.Time
+		v1Sunset      time.Time
+	}
 }
 
 type application struct {
 	config  config
 	storage *storage
 	mailer  *mailer
+	usage   *usageCounter
+	keys    *keyRing
+	limiter *rateLimiter
+	// mux serves every route, the batch endpoint dispatches through it
+	mux *http.ServeMux
 }
 
 func main() {
@@ -55,6 +76,9 @@ func main() {
 	var cfg config
 	flag.IntVar(&cfg.port, "port", 3000, "Server Port")
 	flag.StringVar(&cfg.env, "evn", "development", "Environment [development|production]")
+	flag.Int64Var(&cfg.maxBodyBytes, "max-body-bytes", 1_048_576, "Max request body size in bytes")
+	flag.BoolVar(&cfg.validateOpenAPI, "validate-openapi", false, "Validate requests and responses against the OpenAPI document, defaults to true in development")
+	flag.StringVar(&cfg.redocIntegrity, "redoc-integrity", os.Getenv("REDOC_INTEGRITY"), "Subresource integrity hash of the pinned Redoc bundle the docs load, e.g. sha384-<base64 digest>")
 
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("DB_DSN"), "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenConnections, "db-max-open-conns", 25, "PostgreSQL max open connections")
@@ -74,12 +98,25 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", os.Getenv("SMTP_SENDER"), "SMTP sender")
 
-	flag.StringVar(&cfg.jwt.secret, "jwt-secret", os.Getenv("JWT_SECRET"), "JWT secret")
+	flag.StringVar(&cfg.jwt.keyDir, "jwt-key-dir", os.Getenv("JWT_KEY_DIR"), "Directory of the <kid>.pem JWT keys, public keys only verify tokens")
+	flag.StringVar(&cfg.jwt.signingKeyID, "jwt-signing-kid", os.Getenv("JWT_SIGNING_KID"), "Id of the key tokens are signed with, optional with a single private key")
+	flag.BoolVar(&cfg.jwt.ephemeral, "jwt-ephemeral", false, "Sign tokens with a key generated at startup when no key directory is set, tokens don't survive a restart")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "todo-api", "JWT issuer")
+	flag.StringVar(&cfg.jwt.audience, "jwt-audience", "todo-api", "JWT audience")
+	flag.DurationVar(&cfg.jwt.leeway, "jwt-leeway", 30*time.Second, "Allowed clock skew when validating token times")
+	flag.DurationVar(&cfg.jwt.accessTokenTTL, "jwt-access-ttl", 15*time.Minute, "How long access tokens are valid")
+	flag.DurationVar(&cfg.jwt.refreshTokenTTL, "jwt-refresh-ttl", 30*24*time.Hour, "How long refresh tokens are valid after their last rotation")
 
 	flag.Float64Var(&cfg.limiter.maxRequestPerSecond, "limiter-max-rps", 2, "Rate Limiter max requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate Limiter max burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long idempotency keys and their responses are kept")
+
+	var v1Deprecation, v1Sunset string
+	flag.StringVar(&v1Deprecation, "v1-deprecation", "", "Date v1 is deprecated from as RFC 3339 or YYYY-MM-DD, empty if it isn't")
+	flag.StringVar(&v1Sunset, "v1-sunset", "", "Date v1 stops being served as RFC 3339 or YYYY-MM-DD, empty if it isn't")
+
 	var trustedOrigins string
 	flag.StringVar(&trustedOrigins, "cors-trusted-origins", "*", "Trusted CORS origins saperated by space")
 	flag.Parse()
@@ -94,25 +131,48 @@ func main() {
 
 	cfg.cors.trustedOrigins = strings.Fields(trustedOrigins)
 
+	validateOpenAPISet := false
+	flag.Visit(func(f *flag.Flag) { validateOpenAPISet = validateOpenAPISet || f.Name == "validate-openapi" })
+	if !validateOpenAPISet {
+		cfg.validateOpenAPI = cfg.env == "development"
+	}
+
+	cfg.versions.v1Deprecation, err = parseDate(v1Deprecation)
+	if err != nil {
+		log.Fatalf(`invalid value %s for flag "v1-deprecation": %v`, v1Deprecation, err)
+	}
+	cfg.versions.v1Sunset, err = parseDate(v1Sunset)
+	if err != nil {
+		log.Fatalf(`invalid value %s for flag "v1-sunset": %v`, v1Sunset, err)
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println("established a connection with database")
 
-	if cfg.jwt.secret == "" {
-		secret := make([]byte, 32)
-		_, err = rand.Read(secret[:])
-		if err != nil {
-			log.Fatal(err)
-		}
-		cfg.jwt.secret = string(secret)
+	var keys *keyRing
+	switch {
+	case cfg.jwt.keyDir != "":
+		keys, err = loadKeyRing(cfg.jwt.keyDir, cfg.jwt.signingKeyID)
+	case cfg.jwt.ephemeral && cfg.env != "production":
+		log.Println("no JWT keys configured, signing with an ephemeral key")
+		keys, err = newEphemeralKeyRing()
+	default:
+		log.Fatal(`flag "jwt-key-dir" must be set, or "jwt-ephemeral" outside of production`)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	app := &application{
 		config:  cfg,
 		storage: newStorage(db),
 		mailer:  newMailer(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		usage:   newUsageCounter(),
+		keys:    keys,
+		limiter: newRateLimiter(cfg.limiter.maxRequestPerSecond, cfg.limiter.burst),
 	}
 
 	srv := &http.Server{
@@ -126,3 +186,16 @@ func main() {
 	err = srv.ListenAndServe()
 	log.Fatal(err)
 }
+
+// parseDate parses an RFC 3339 timestamp or a date, the empty string is the
+// zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, s)
+	}
+	return t, err
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/time/rate"
 )
 
@@ -20,116 +25,340 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 		w.Header().Add("Vary", "Authorization")
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			writeError(w, errors.New("invalid Authorization header"), http.StatusUnauthorized)
+			writeError(w, r, problemInvalidAuthorization, "")
 			return
 		}
 		parts := strings.Fields(authHeader)
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			writeError(w, errors.New("invalid Authorization header"), http.StatusUnauthorized)
+			writeError(w, r, problemInvalidAuthorization, "")
 			return
 		}
 		tokenStr := parts[1]
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return []byte(app.config.jwt.secret), nil
-		})
-		if err != nil {
-			log.Println(err)
-			writeError(w, errors.New("invalid token"), http.StatusUnauthorized)
+		if strings.HasPrefix(tokenStr, personalAccessTokenPrefix) {
+			app.authenticatePersonalAccessToken(w, r, tokenStr, next)
 			return
 		}
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
+		claims := &accessTokenClaims{}
+		_, err := jwt.ParseWithClaims(tokenStr, claims, app.keys.keyFunc,
+			jwt.WithValidMethods(app.keys.methods()),
+			jwt.WithIssuer(app.config.jwt.issuer),
+			jwt.WithAudience(app.config.jwt.audience),
+			jwt.WithLeeway(app.config.jwt.leeway),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		)
+		if err != nil {
 			log.Println(err)
-			writeError(w, errors.New("invalid token"), http.StatusUnauthorized)
+			writeError(w, r, problemInvalidToken, "")
 			return
 		}
-		userID := int(claims["user_id"].(float64))
-		expiresAtStr := claims["expires_at"].(string)
-		expiresAt, err := time.Parse(time.RFC822, expiresAtStr)
+		userID, err := strconv.Atoi(claims.Subject)
 		if err != nil {
-			log.Println(err)
-			writeError(w, errors.New("invalid token"), http.StatusUnauthorized)
+			writeError(w, r, problemInvalidToken, "")
 			return
 		}
+		t := &accessToken{
+			ID:        claims.ID,
+			SessionID: claims.SessionID,
+			ExpiresAt: claims.ExpiresAt.Time,
+		}
 
-		if time.Now().After(expiresAt) {
-			writeError(w, errors.New("invalid token"), http.StatusUnauthorized)
+		if t.ID == "" || app.storageFor(r).isTokenRevoked(t.ID) {
+			writeError(w, r, problemInvalidToken, "")
 			return
 		}
-		u, err := app.storage.getUserByID(userID)
+		u, err := app.storageFor(r).getUserByID(userID)
 		if err != nil {
 			log.Println(err)
-			writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+			writeError(w, r, problemInternal, "")
 			return
 		}
 		if u == nil {
-			writeError(w, errors.New("user no longer exists"), http.StatusUnauthorized)
+			writeError(w, r, problemUnknownUser, "")
+			return
+		}
+		if claims.CredentialVersion != u.CredentialVersion {
+			writeError(w, r, problemInvalidToken, "the token was issued before the credentials changed")
+			return
+		}
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		active, err := app.storageFor(r).touchSession(t.SessionID, u.ID, ip)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		if !active {
+			writeError(w, r, problemInvalidToken, "the session of the token was revoked")
 			return
 		}
 		ctx := context.WithValue(r.Context(), userContextKey, u)
+		ctx = context.WithValue(ctx, accessTokenContextKey, t)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+func (app *application) authenticatePersonalAccessToken(w http.ResponseWriter, r *http.Request, tokenStr string, next http.HandlerFunc) {
+	hash := sha256.Sum256([]byte(tokenStr))
+	t, err := app.storageFor(r).getPersonalAccessTokenByHash(hash[:])
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if t == nil || (t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)) {
+		writeError(w, r, problemInvalidToken, "")
+		return
+	}
+	u, err := app.storageFor(r).getUserByID(t.UserID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u == nil {
+		writeError(w, r, problemUnknownUser, "")
+		return
+	}
+	err = app.storageFor(r).touchPersonalAccessToken(t)
+	if err != nil {
+		log.Println(err)
+	}
+	ctx := context.WithValue(r.Context(), userContextKey, u)
+	ctx = context.WithValue(ctx, personalAccessTokenContextKey, t)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// requireScope lets personal access tokens through only when they were granted
+// the scope, routes without a scope are reserved to session tokens.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := getPersonalAccessTokenFromRequest(r)
+		if t != nil && (scope == "" || !slices.Contains(t.Scopes, scope)) {
+			detail := "personal access tokens can't be used on this route"
+			if scope != "" {
+				detail = fmt.Sprintf("the token must be granted the scope %q", scope)
+			}
+			writeError(w, r, problemInsufficientScope, detail)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
 func requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := getUserFromRequest(r)
 		if !user.IsActivated {
-			writeError(w, errors.New("your user account must be activated to access this resource"), http.StatusForbidden)
+			writeError(w, r, problemUserNotActivated, "your user account must be activated to access this resource")
 			return
 		}
 		next.ServeHTTP(w, r)
 	}
 }
 
-func (app *application) rateLimit(next http.Handler) http.HandlerFunc {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-	var (
-		mu      sync.RWMutex
-		clients = make(map[string]client)
-	)
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	rr.statusCode = statusCode
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.statusCode == 0 {
+		rr.statusCode = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// idempotent makes retries of a request carrying an Idempotency-Key header safe,
+// the first response for a key is stored and replayed for exact repeats. Keys
+// are scoped to the authenticated user when there is one. Routes that issue
+// tokens mustn't use it, the stored responses would keep live tokens around.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, r, problemValidationFailed, `header "Idempotency-Key" must be atmost 255 characters`)
+			return
+		}
+
+		body, ok := app.readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.New()
+		fmt.Fprintf(fingerprint, "%s %s\n", r.Method, r.URL.RequestURI())
+		// replays are stored in the negotiated format
+		if c := negotiate(r); c != nil {
+			fmt.Fprintln(fingerprint, c.mediaType)
+		}
+		fingerprint.Write(body)
+
+		rec := &idempotencyRecord{
+			Key:         key,
+			ExpiresAt:   time.Now().Add(app.config.idempotency.ttl),
+			Fingerprint: fingerprint.Sum(nil),
+		}
+		if u := getUserFromRequest(r); u != nil {
+			rec.UserID = u.ID
+		} else {
+			// anonymous keys are scoped to the client and the route, so unrelated
+			// clients don't share a namespace. The batch route is anonymous, its
+			// sub-requests carry the credentials.
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			scope := strings.Join([]string{ip, r.Header.Get("Authorization"), r.Method, r.URL.Path, key}, "\n")
+			scoped := sha256.Sum256([]byte(scope))
+			rec.Key = "anonymous:" + hex.EncodeToString(scoped[:])
+		}
+
+		locked, err := app.storageFor(r).lockIdempotencyKey(rec)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		if !locked {
+			stored, err := app.storageFor(r).getIdempotencyKey(rec.UserID, rec.Key)
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, problemInternal, "")
+				return
+			}
+			switch {
+			case stored == nil:
+				// the key expired and was removed in between, let the client retry
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, problemIdempotencyKeyInProgress, "")
+			case !bytes.Equal(stored.Fingerprint, rec.Fingerprint):
+				writeError(w, r, problemIdempotencyKeyReused, "")
+			case stored.StatusCode == 0:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, problemIdempotencyKeyInProgress, "")
+			default:
+				for k, v := range stored.Header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		rr := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rr, r)
+
+		// server errors aren't stored so that a retry gets another chance, nor
+		// are responses that mustn't be stored, such as batches that hand out
+		// credentials
+		if rr.statusCode == 0 || rr.statusCode >= 500 || strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+			err = app.storageFor(r).deleteIdempotencyKey(rec)
+		} else {
+			rec.StatusCode = rr.statusCode
+			rec.Header = w.Header().Clone()
+			rec.Body = rr.body.Bytes()
+			err = app.storageFor(r).saveIdempotencyResponse(rec)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// noStore marks the responses of routes that hand out credentials as not to be
+// stored. Those can't be replayed, so an Idempotency-Key is refused rather than
+// silently ignored.
+func noStore(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Idempotency-Key") != "" {
+			writeError(w, r, problemIdempotencyUnsupported, "the response of this route can't be stored for replays")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	}
+}
+
+// rateLimiter hands out a token bucket per client IP, buckets of clients that
+// haven't been seen for a few minutes are dropped.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*rateLimiterClient
+}
+
+type rateLimiterClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	l := &rateLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*rateLimiterClient),
+	}
 	go func() {
 		for {
 			time.Sleep(time.Minute)
 			func() {
-				mu.Lock()
-				defer mu.Unlock()
-				for ip, client := range clients {
-					if time.Since(client.lastSeen) >= time.Minute*3 {
-						delete(clients, ip)
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				for ip, c := range l.clients {
+					if time.Since(c.lastSeen) >= time.Minute*3 {
+						delete(l.clients, ip)
 					}
 				}
 			}()
 		}
 	}()
+	return l
+}
+
+func (l *rateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &rateLimiterClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter.Allow()
+}
+
+// rateLimit spends a token of the client's bucket on every request, a batch
+// counts as one request.
+func (app *application) rateLimit(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ip, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
 			log.Println(err)
-			writeError(w, errors.New("internal server error"), http.StatusInternalServerError)
+			writeError(w, r, problemInternal, "")
 			return
 		}
-		mu.Lock()
-		c, ok := clients[ip]
-		if !ok {
-			c = client{
-				limiter: rate.NewLimiter(rate.Limit(app.config.limiter.maxRequestPerSecond), app.config.limiter.burst),
-			}
-		}
-		c.lastSeen = time.Now()
-		clients[ip] = c
-		if !c.limiter.Allow() {
-			mu.Unlock()
-			writeError(w, errors.New("rate limit exceeded"), http.StatusTooManyRequests)
+		if !app.limiter.allow(ip) {
+			writeError(w, r, problemRateLimitExceeded, "")
 			return
 		}
-		mu.Unlock()
 		next.ServeHTTP(w, r)
 	}
 }
@@ -147,7 +376,7 @@ func (app *application) enableCORS(next http.Handler) http.HandlerFunc {
 					// preflight request
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, If-Modified-Since, Idempotency-Key")
 						w.WriteHeader(http.StatusOK)
 						return
 					}
@@ -167,3 +396,67 @@ func getUserFromRequest(r *http.Request) *user {
 	u, _ := r.Context().Value(userContextKey).(*user)
 	return u
 }
+
+const accessTokenContextKey userContext = "accessTokenContextKey"
+
+// accessToken holds the claims of the token a request was authenticated with.
+type accessToken struct {
+	ID        string
+	SessionID int
+	ExpiresAt time.Time
+}
+
+func getAccessTokenFromRequest(r *http.Request) *accessToken {
+	t, _ := r.Context().Value(accessTokenContextKey).(*accessToken)
+	return t
+}
+
+const storageContextKey userContext = "storageContextKey"
+
+// storageFor returns the storage bound to the transaction of the atomic batch
+// the request is part of, or the application's storage otherwise.
+func (app *application) storageFor(r *http.Request) *storage {
+	if s, ok := r.Context().Value(storageContextKey).(*storage); ok {
+		return s
+	}
+	return app.storage
+}
+
+// inTx runs f with a request whose storage is bound to a transaction, which is
+// committed if f succeeds. Requests of an atomic batch already are, f then runs
+// in the transaction of the batch.
+func (app *application) inTx(r *http.Request, f func(r *http.Request) error) error {
+	if app.storageFor(r).tx != nil {
+		return f(r)
+	}
+	tx, err := app.storage.beginTx(r.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	s := app.storage.withTx(tx)
+	err = f(r.WithContext(context.WithValue(r.Context(), storageContextKey, s)))
+	if err != nil {
+		return err
+	}
+	return s.commit()
+}
+
+const personalAccessTokenContextKey userContext = "personalAccessTokenContextKey"
+
+func getPersonalAccessTokenFromRequest(r *http.Request) *personalAccessToken {
+	t, _ := r.Context().Value(personalAccessTokenContextKey).(*personalAccessToken)
+	return t
+}
+
+// requireAcceptable responds with 406 before the handler runs when none of the
+// types in the Accept header can be produced.
+func requireAcceptable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if negotiate(r) == nil {
+			writeError(w, r, problemNotAcceptable, "Accept must allow one of "+strings.Join(supportedMediaTypes(), ", "))
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+const docsHTML = `<!doctype html>
+<html>
+    <head>
+        <title>Todo API</title>
+        <meta charset="utf-8" />
+        <meta name="viewport" content="width=device-width, initial-scale=1" />
+    </head>
+    <body>
+        <redoc spec-url="openapi.json"></redoc>
+        <script src="https://cdn.redoc.ly/redoc/v2.1.5/bundles/redoc.standalone.js"%s crossorigin="anonymous"></script>
+    </body>
+</html>
+`
+
+// schemaBuilder derives JSON Schemas from Go types through their json tags,
+// named struct types are collected as reusable components. Substitutes replace
+// types whose shape differs in the documented API version.
+type schemaBuilder struct {
+	components  map[string]map[string]any
+	substitutes map[reflect.Type]reflect.Type
+}
+
+func newSchemaBuilder(substitutes map[reflect.Type]reflect.Type) *schemaBuilder {
+	return &schemaBuilder{
+		components:  make(map[string]map[string]any),
+		substitutes: substitutes,
+	}
+}
+
+func (b *schemaBuilder) schemaOf(v any) map[string]any {
+	return b.schemaFor(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]any {
+	if s, ok := b.substitutes[t]; ok {
+		t = s
+	}
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.schemaFor(t.Elem())
+		if typ, ok := s["type"].(string); ok {
+			nullable := make(map[string]any, len(s))
+			for k, v := range s {
+				nullable[k] = v
+			}
+			nullable["type"] = []string{typ, "null"}
+			return nullable
+		}
+		return map[string]any{"anyOf": []any{s, map[string]any{"type": "null"}}}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := b.components[name]; !ok {
+			// registered before building so that recursive types terminate
+			b.components[name] = map[string]any{}
+			b.components[name] = b.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = b.schemaFor(f.Type)
+	}
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func (b *schemaBuilder) resolve(s map[string]any) map[string]any {
+	ref, ok := s["$ref"].(string)
+	if !ok {
+		return s
+	}
+	return b.components[strings.TrimPrefix(ref, "#/components/schemas/")]
+}
+
+// validate checks v against the schema, additional object properties are only
+// reported when strict is set.
+func (b *schemaBuilder) validate(s map[string]any, v any, path string, strict bool) []fieldViolation {
+	s = b.resolve(s)
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		var violations []fieldViolation
+		for _, alt := range anyOf {
+			violations = b.validate(alt.(map[string]any), v, path, strict)
+			if len(violations) == 0 {
+				return nil
+			}
+		}
+		return violations
+	}
+
+	field := path
+	if field == "" {
+		field = "body"
+	}
+
+	var types []string
+	switch typ := s["type"].(type) {
+	case string:
+		types = []string{typ}
+	case []string:
+		types = typ
+	default:
+		return nil
+	}
+	actual := jsonType(v)
+	if !slices.Contains(types, actual) && !(actual == "integer" && slices.Contains(types, "number")) {
+		return []fieldViolation{{Field: field, Message: fmt.Sprintf("must be of type %s", strings.Join(types, " or "))}}
+	}
+
+	var violations []fieldViolation
+	switch v := v.(type) {
+	case string:
+		if s["format"] == "date-time" {
+			_, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				violations = append(violations, fieldViolation{Field: field, Message: "must be an RFC 3339 timestamp"})
+			}
+		}
+	case []any:
+		items, ok := s["items"].(map[string]any)
+		if ok {
+			for i, item := range v {
+				violations = append(violations, b.validate(items, item, fmt.Sprintf("%s[%d]", path, i), strict)...)
+			}
+		}
+	case map[string]any:
+		properties, _ := s["properties"].(map[string]any)
+		additional, _ := s["additionalProperties"].(map[string]any)
+		for k, item := range v {
+			name := k
+			if path != "" {
+				name = path + "." + k
+			}
+			switch {
+			case properties[k] != nil:
+				violations = append(violations, b.validate(properties[k].(map[string]any), item, name, strict)...)
+			case additional != nil:
+				violations = append(violations, b.validate(additional, item, name, strict)...)
+			case strict && s["additionalProperties"] == false:
+				violations = append(violations, fieldViolation{Field: name, Message: "is not a known field"})
+			}
+		}
+	}
+	return violations
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func operationID(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	name = strings.TrimSuffix(name, "-fm")
+	return strings.TrimSuffix(name, "Handler")
+}
+
+// mediaTypeContent lists the schema under every supported media type, with
+// jsonType standing in for JSON.
+func mediaTypeContent(schema map[string]any, jsonType string) map[string]any {
+	content := make(map[string]any, len(codecs))
+	for _, c := range codecs {
+		mediaType := c.mediaType
+		if c == jsonCodec {
+			mediaType = jsonType
+		}
+		content[mediaType] = map[string]any{"schema": schema}
+	}
+	return content
+}
+
+func (app *application) openAPIDocument(v apiVersion) map[string]any {
+	b := newSchemaBuilder(v.substitutes)
+	problemSchema := b.schemaOf(problem{})
+
+	paths := make(map[string]map[string]any)
+	for _, rt := range app.routeTable() {
+		op := map[string]any{
+			"operationId": operationID(rt.handler),
+			"summary":     rt.summary,
+		}
+		if !v.deprecation.IsZero() {
+			op["deprecated"] = true
+		}
+
+		parameters := make([]any, 0)
+		for _, segment := range strings.Split(rt.path, "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				name := strings.Trim(segment, "{}")
+				typ := "string"
+				if name == "id" {
+					typ = "integer"
+				}
+				parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": typ}})
+			}
+		}
+		for _, q := range rt.query {
+			parameters = append(parameters, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		if rt.idempotent {
+			parameters = append(parameters, map[string]any{"name": "Idempotency-Key", "in": "header", "schema": map[string]any{"type": "string", "maxLength": 255}})
+		}
+		if len(parameters) != 0 {
+			op["parameters"] = parameters
+		}
+		if rt.auth {
+			// scopes only restrict personal access tokens
+			scopes := []string{}
+			if rt.scope != "" {
+				scopes = append(scopes, rt.scope)
+			}
+			op["security"] = []any{map[string]any{"bearerAuth": scopes}}
+		}
+
+		switch {
+		case rt.method == http.MethodPatch:
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/merge-patch+json": map[string]any{"schema": map[string]any{"type": "object"}},
+					"application/json-patch+json":  map[string]any{"schema": b.schemaOf([]patchOperation{})},
+				},
+			}
+		case rt.request != nil:
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  mediaTypeContent(b.schemaOf(rt.request), jsonCodec.mediaType),
+			}
+		}
+
+		success := map[string]any{"description": http.StatusText(rt.status)}
+		if rt.response != nil {
+			success["content"] = mediaTypeContent(b.schemaOf(rt.response), jsonCodec.mediaType)
+		}
+		op["responses"] = map[string]any{
+			fmt.Sprint(rt.status): success,
+			"default": map[string]any{
+				"description": "Error",
+				"content":     mediaTypeContent(problemSchema, "application/problem+json"),
+			},
+		}
+
+		path := "/" + v.name + rt.path
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][strings.ToLower(rt.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Todo API",
+			"version": version + "-" + v.name,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": b.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "A session JWT or a personal access token"},
+			},
+		},
+	}
+}
+
+func (app *application) getOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, app.openAPIDocument(app.versionOf(r)), http.StatusOK)
+}
+
+func (app *application) getDocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the pinned bundle is only run when it matches its subresource integrity
+	integrity := ""
+	if app.config.redocIntegrity != "" {
+		integrity = ` integrity="` + html.EscapeString(app.config.redocIntegrity) + `"`
+	}
+	fmt.Fprintf(w, docsHTML, integrity)
+}
+
+// validateOpenAPI checks requests and responses of the route against its
+// schemas, it's installed in development or with the validate-openapi flag so
+// that drift between handlers and the route table is caught early.
+func (app *application) validateOpenAPI(b *schemaBuilder, rt route, next http.HandlerFunc) http.HandlerFunc {
+	var requestSchema, responseSchema map[string]any
+	if rt.request != nil && rt.method != http.MethodPatch {
+		requestSchema = b.schemaOf(rt.request)
+	}
+	if rt.response != nil {
+		responseSchema = b.schemaOf(rt.response)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestSchema != nil {
+			body, ok := app.readBody(w, r)
+			if !ok {
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			// malformed bodies and unsupported formats are left for the handler to report
+			c := codecFor(r.Header.Get("Content-Type"))
+			if c == nil {
+				c = jsonCodec
+			}
+			doc, err := c.decode(body)
+			if err == nil {
+				violations := b.validate(requestSchema, doc, "", true)
+				if len(violations) != 0 {
+					p := newProblem(r, problemRequestSchemaViolation, "request body doesn't match the OpenAPI document")
+					p.Errors = violations
+					writeProblem(w, r, p)
+					return
+				}
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		c := codecFor(rec.Header().Get("Content-Type"))
+		if responseSchema != nil && rec.Code == rt.status && c != nil {
+			doc, err := c.decode(rec.Body.Bytes())
+			if err == nil {
+				violations := b.validate(responseSchema, doc, "", false)
+				if len(violations) != 0 {
+					log.Printf("response of %s %s doesn't match the OpenAPI document: %v", rt.method, rt.path, violations)
+					p := newProblem(r, problemResponseSchemaViolation, "response body doesn't match the OpenAPI document")
+					p.Errors = violations
+					writeProblem(w, r, p)
+					return
+				}
+			}
+		}
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}
+}
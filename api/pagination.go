@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type metadata struct {
+	CurrentPage  int  `json:"current_page"`
+	PageSize     int  `json:"page_size"`
+	FirstPage    int  `json:"first_page"`
+	LastPage     int  `json:"last_page"`
+	TotalRecords int  `json:"total_records"`
+	HasNext      bool `json:"has_next"`
+}
+
+func calculateMetadata(total, page, pageSize int) metadata {
+	lastPage := max(1, (total+pageSize-1)/pageSize)
+	return metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     lastPage,
+		TotalRecords: total,
+		HasNext:      page < lastPage,
+	}
+}
+
+func readPagination(query url.Values, v *validator) (int, int) {
+	page := 1
+	pageSize := 20
+
+	pageStr := query.Get("page")
+	if pageStr != "" {
+		p, err := strconv.Atoi(pageStr)
+		v.checkCond(err == nil, "page", "must be a positive integer")
+		page = p
+	}
+	pageSizeStr := query.Get("page_size")
+	if pageSizeStr != "" {
+		size, err := strconv.Atoi(pageSizeStr)
+		v.checkCond(err == nil, "page_size", "must be a positive integer")
+		pageSize = size
+	}
+
+	v.checkCond(page >= 1 && page <= 10_000_000, "page", "must be between 1 and 10_000_000")
+	v.checkCond(pageSize >= 1 && pageSize <= 100, "page_size", "must be between 1 and 100")
+	return page, pageSize
+}
+
+// writePagination sets RFC 8288 Link headers for the first, last, previous and
+// next pages of a list response and returns the metadata to embed in its body.
+func writePagination(w http.ResponseWriter, r *http.Request, total, page, pageSize int) metadata {
+	m := calculateMetadata(total, page, pageSize)
+
+	links := []string{
+		composePageLink(r, m.FirstPage, pageSize, "first"),
+		composePageLink(r, m.LastPage, pageSize, "last"),
+	}
+	if page > m.FirstPage {
+		links = append(links, composePageLink(r, min(page-1, m.LastPage), pageSize, "prev"))
+	}
+	if m.HasNext {
+		links = append(links, composePageLink(r, page+1, pageSize, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+	return m
+}
+
+func composePageLink(r *http.Request, page, pageSize int, rel string) string {
+	u := *r.URL
+	u.Scheme = "http"
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Host = r.Host
+
+	query := u.Query()
+	query.Set("page", strconv.Itoa(page))
+	query.Set("page_size", strconv.Itoa(pageSize))
+	u.RawQuery = query.Encode()
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+}
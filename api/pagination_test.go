@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCalculateMetadata(t *testing.T) {
+	tests := []struct {
+		total, page, pageSize int
+		want                  metadata
+	}{
+		{0, 1, 20, metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 0, HasNext: false}},
+		{1, 1, 20, metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 1, HasNext: false}},
+		{20, 1, 20, metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 20, HasNext: false}},
+		{21, 1, 20, metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 2, TotalRecords: 21, HasNext: true}},
+		{21, 2, 20, metadata{CurrentPage: 2, PageSize: 20, FirstPage: 1, LastPage: 2, TotalRecords: 21, HasNext: false}},
+		{100, 3, 10, metadata{CurrentPage: 3, PageSize: 10, FirstPage: 1, LastPage: 10, TotalRecords: 100, HasNext: true}},
+		{5, 4, 2, metadata{CurrentPage: 4, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5, HasNext: false}},
+	}
+	for _, tt := range tests {
+		got := calculateMetadata(tt.total, tt.page, tt.pageSize)
+		if got != tt.want {
+			t.Errorf("calculateMetadata(%d, %d, %d) = %+v, want %+v", tt.total, tt.page, tt.pageSize, got, tt.want)
+		}
+	}
+}
+
+func TestWritePagination(t *testing.T) {
+	tests := []struct {
+		target                string
+		total, page, pageSize int
+		want                  string
+	}{
+		{
+			"/v1/tasks", 0, 1, 20,
+			`<http://example.com/v1/tasks?page=1&page_size=20>; rel="first", ` +
+				`<http://example.com/v1/tasks?page=1&page_size=20>; rel="last"`,
+		},
+		{
+			"/v1/tasks?sort=-id", 45, 1, 20,
+			`<http://example.com/v1/tasks?page=1&page_size=20&sort=-id>; rel="first", ` +
+				`<http://example.com/v1/tasks?page=3&page_size=20&sort=-id>; rel="last", ` +
+				`<http://example.com/v1/tasks?page=2&page_size=20&sort=-id>; rel="next"`,
+		},
+		{
+			"/v1/tasks?page=2&page_size=20", 45, 2, 20,
+			`<http://example.com/v1/tasks?page=1&page_size=20>; rel="first", ` +
+				`<http://example.com/v1/tasks?page=3&page_size=20>; rel="last", ` +
+				`<http://example.com/v1/tasks?page=1&page_size=20>; rel="prev", ` +
+				`<http://example.com/v1/tasks?page=3&page_size=20>; rel="next"`,
+		},
+		{
+			"/v1/tasks?page=3", 45, 3, 20,
+			`<http://example.com/v1/tasks?page=1&page_size=20>; rel="first", ` +
+				`<http://example.com/v1/tasks?page=3&page_size=20>; rel="last", ` +
+				`<http://example.com/v1/tasks?page=2&page_size=20>; rel="prev"`,
+		},
+		{
+			// past the last page prev points back at the last one
+			"/v1/tasks?page=9", 45, 9, 20,
+			`<http://example.com/v1/tasks?page=1&page_size=20>; rel="first", ` +
+				`<http://example.com/v1/tasks?page=3&page_size=20>; rel="last", ` +
+				`<http://example.com/v1/tasks?page=3&page_size=20>; rel="prev"`,
+		},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.target, nil)
+		m := writePagination(w, r, tt.total, tt.page, tt.pageSize)
+		if want := calculateMetadata(tt.total, tt.page, tt.pageSize); m != want {
+			t.Errorf("writePagination(%s) = %+v, want %+v", tt.target, m, want)
+		}
+		if got := w.Header().Get("Link"); got != tt.want {
+			t.Errorf("writePagination(%s) Link = %s, want %s", tt.target, got, tt.want)
+		}
+	}
+}
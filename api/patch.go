@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	errUnsupportedPatchType = errors.New("unsupported patch media type")
+	errPatchTestFailed      = errors.New("patch test operation failed")
+)
+
+const acceptPatch = "application/merge-patch+json, application/json-patch+json"
+
+// applyPatch applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// document to doc depending on the request content type.
+func applyPatch(contentType string, doc, patch []byte) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errUnsupportedPatchType
+	}
+
+	var target any
+	err = json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case "application/merge-patch+json":
+		var p any
+		err = json.Unmarshal(patch, &p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merge patch: %w", err)
+		}
+		target = applyMergePatch(target, p)
+	case "application/json-patch+json":
+		var ops []patchOperation
+		err = json.Unmarshal(patch, &ops)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json patch: %w", err)
+		}
+		target, err = applyJSONPatch(target, ops)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errUnsupportedPatchType
+	}
+	return json.Marshal(target)
+}
+
+func applyMergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = applyMergePatch(t[k], v)
+	}
+	return t
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func applyJSONPatch(doc any, ops []patchOperation) (any, error) {
+	for i, op := range ops {
+		var err error
+		doc, err = applyPatchOperation(doc, op)
+		if err != nil {
+			if errors.Is(err, errPatchTestFailed) {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+			return nil, fmt.Errorf("invalid json patch: operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyPatchOperation(doc any, op patchOperation) (any, error) {
+	if op.Path == nil {
+		return nil, errors.New(`"path" must be provided`)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+		if op.Value == nil {
+			return nil, errors.New(`"value" must be provided`)
+		}
+		err = json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var from []string
+	if op.Op == "move" || op.Op == "copy" {
+		if op.From == nil {
+			return nil, errors.New(`"from" must be provided`)
+		}
+		from, err = parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err = pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, _, err = pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move":
+		if len(from) < len(path) && slices.Equal(from, path[:len(from)]) {
+			return nil, errors.New(`"from" must not be a prefix of "path"`)
+		}
+		doc, value, err = pointerRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "copy":
+		value, err = pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// values are copied so that later operations don't alias both locations
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		var clone any
+		err = json.Unmarshal(data, &clone)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, clone)
+	case "test":
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, fmt.Errorf("%w: value at %q doesn't match", errPatchTestFailed, *op.Path)
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		t = strings.ReplaceAll(t, "~1", "/")
+		tokens[i] = strings.ReplaceAll(t, "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token, RFC 6901 only allows digits without
+// leading zeros so signs are rejected along with them.
+func arrayIndex(token string, length int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i >= length || strings.Trim(token, "0123456789") != "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func pointerGet(node any, path []string) (any, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("path %q doesn't exist", token)
+			}
+			node = child
+		case []any:
+			i, err := arrayIndex(token, len(n))
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("path %q doesn't exist", token)
+		}
+	}
+	return node, nil
+}
+
+func pointerAdd(node any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+	switch n := node.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, fmt.Errorf("path %q doesn't exist", token)
+		}
+		child, err := pointerAdd(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[token] = child
+		return n, nil
+	case []any:
+		if len(path) == 1 {
+			if token == "-" {
+				return append(n, value), nil
+			}
+			i, err := arrayIndex(token, len(n)+1)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Insert(n, i, value), nil
+		}
+		i, err := arrayIndex(token, len(n))
+		if err != nil {
+			return nil, err
+		}
+		child, err := pointerAdd(n[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = child
+		return n, nil
+	default:
+		return nil, fmt.Errorf("path %q doesn't exist", token)
+	}
+}
+
+func pointerRemove(node any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("can't remove the whole document")
+	}
+	token := path[0]
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("path %q doesn't exist", token)
+		}
+		if len(path) == 1 {
+			delete(n, token)
+			return n, child, nil
+		}
+		child, removed, err := pointerRemove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[token] = child
+		return n, removed, nil
+	case []any:
+		i, err := arrayIndex(token, len(n))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := n[i]
+			return slices.Delete(n, i, i+1), removed, nil
+		}
+		child, removed, err := pointerRemove(n[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[i] = child
+		return n, removed, nil
+	default:
+		return nil, nil, fmt.Errorf("path %q doesn't exist", token)
+	}
+}
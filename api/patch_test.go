@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+var patchTests = []struct {
+	name        string
+	contentType string
+	doc         string
+	patch       string
+	want        string
+	err         bool
+}{
+	// RFC 7396 appendix A
+	{"merge replace", mergePatchType, `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`, false},
+	{"merge add", mergePatchType, `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`, false},
+	{"merge remove", mergePatchType, `{"a":"b"}`, `{"a":null}`, `{}`, false},
+	{"merge array replaced", mergePatchType, `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`, false},
+	{"merge nested", mergePatchType, `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`, false},
+	{"merge keeps null", mergePatchType, `{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`, false},
+	{"merge non object", mergePatchType, `{"a":"foo"}`, `["c"]`, `["c"]`, false},
+
+	{"add member", jsonPatchType, `{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`, false},
+	{"add replaces member", jsonPatchType, `{"a":1}`, `[{"op":"add","path":"/a","value":2}]`, `{"a":2}`, false},
+	{"add inserts", jsonPatchType, `{"a":[1,2]}`, `[{"op":"add","path":"/a/1","value":3}]`, `{"a":[1,3,2]}`, false},
+	{"add at length", jsonPatchType, `{"a":[1,2]}`, `[{"op":"add","path":"/a/2","value":3}]`, `{"a":[1,2,3]}`, false},
+	{"add appends", jsonPatchType, `{"a":[1,2]}`, `[{"op":"add","path":"/a/-","value":3}]`, `{"a":[1,2,3]}`, false},
+	{"add past length", jsonPatchType, `{"a":[1,2]}`, `[{"op":"add","path":"/a/3","value":3}]`, "", true},
+	{"add missing parent", jsonPatchType, `{}`, `[{"op":"add","path":"/a/b","value":1}]`, "", true},
+	{"add without value", jsonPatchType, `{}`, `[{"op":"add","path":"/a"}]`, "", true},
+	{"leading zero", jsonPatchType, `{"a":[1,2]}`, `[{"op":"replace","path":"/a/01","value":3}]`, "", true},
+	{"signed index", jsonPatchType, `{"a":[1,2]}`, `[{"op":"replace","path":"/a/+1","value":3}]`, "", true},
+	{"remove member", jsonPatchType, `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`, false},
+	{"remove element", jsonPatchType, `{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/1"}]`, `{"a":[1,3]}`, false},
+	{"remove end of array", jsonPatchType, `{"a":[1]}`, `[{"op":"remove","path":"/a/-"}]`, "", true},
+	{"remove missing", jsonPatchType, `{}`, `[{"op":"remove","path":"/a"}]`, "", true},
+	{"replace member", jsonPatchType, `{"a":1}`, `[{"op":"replace","path":"/a","value":[2]}]`, `{"a":[2]}`, false},
+	{"replace element", jsonPatchType, `{"a":[1,2]}`, `[{"op":"replace","path":"/a/0","value":3}]`, `{"a":[3,2]}`, false},
+	{"replace document", jsonPatchType, `{"a":1}`, `[{"op":"replace","path":"","value":{"b":2}}]`, `{"b":2}`, false},
+	{"replace missing", jsonPatchType, `{}`, `[{"op":"replace","path":"/a","value":1}]`, "", true},
+	{"move member", jsonPatchType, `{"a":{"b":1}}`, `[{"op":"move","from":"/a/b","path":"/c"}]`, `{"a":{},"c":1}`, false},
+	{"move element", jsonPatchType, `{"a":[1,2,3]}`, `[{"op":"move","from":"/a/0","path":"/a/-"}]`, `{"a":[2,3,1]}`, false},
+	{"move into itself", jsonPatchType, `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b"}]`, "", true},
+	{"move without from", jsonPatchType, `{"a":1}`, `[{"op":"move","path":"/b"}]`, "", true},
+	{"copy member", jsonPatchType, `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"}]`, `{"a":{"b":1},"c":{"b":1}}`, false},
+	{"copy doesn't alias", jsonPatchType, `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`, false},
+	{"test passes", jsonPatchType, `{"a":[1,{"b":"c"}]}`, `[{"op":"test","path":"/a","value":[1,{"b":"c"}]}]`, `{"a":[1,{"b":"c"}]}`, false},
+	{"test missing", jsonPatchType, `{}`, `[{"op":"test","path":"/a","value":1}]`, "", true},
+	{"escaped tokens", jsonPatchType, `{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1},{"op":"replace","path":"/m~0n","value":3}]`, `{"a/b":1,"m~n":3}`, false},
+	{"escape order", jsonPatchType, `{"~1":1}`, `[{"op":"remove","path":"/~01"}]`, `{}`, false},
+	{"empty token", jsonPatchType, `{"":1}`, `[{"op":"replace","path":"/","value":2}]`, `{"":2}`, false},
+	{"unescaped pointer", jsonPatchType, `{"a":1}`, `[{"op":"remove","path":"a"}]`, "", true},
+	{"unknown op", jsonPatchType, `{"a":1}`, `[{"op":"delete","path":"/a"}]`, "", true},
+	{"without path", jsonPatchType, `{"a":1}`, `[{"op":"remove"}]`, "", true},
+	{"all or nothing", jsonPatchType, `{"a":1}`, `[{"op":"remove","path":"/a"},{"op":"remove","path":"/a"}]`, "", true},
+}
+
+func TestApplyPatch(t *testing.T) {
+	for _, tt := range patchTests {
+		got, err := applyPatch(tt.contentType, []byte(tt.doc), []byte(tt.patch))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: applyPatch = %s, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: applyPatch error: %v", tt.name, err)
+			continue
+		}
+		var gotDoc, wantDoc any
+		json.Unmarshal(got, &gotDoc)
+		json.Unmarshal([]byte(tt.want), &wantDoc)
+		if !reflect.DeepEqual(gotDoc, wantDoc) {
+			t.Errorf("%s: applyPatch = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyPatchErrors(t *testing.T) {
+	_, err := applyPatch("text/plain", []byte(`{}`), []byte(`{}`))
+	if !errors.Is(err, errUnsupportedPatchType) {
+		t.Errorf("applyPatch with text/plain = %v, want %v", err, errUnsupportedPatchType)
+	}
+	_, err = applyPatch(jsonPatchType, []byte(`{"a":1}`), []byte(`[{"op":"test","path":"/a","value":2}]`))
+	if !errors.Is(err, errPatchTestFailed) {
+		t.Errorf("applyPatch with a failing test = %v, want %v", err, errPatchTestFailed)
+	}
+}
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    []string
+		err     bool
+	}{
+		{"", nil, false},
+		{"/", []string{""}, false},
+		{"/a/0", []string{"a", "0"}, false},
+		{"/a~1b/m~0n", []string{"a/b", "m~n"}, false},
+		{"/~01", []string{"~1"}, false},
+		{"a", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePointer(tt.pointer)
+		if (err != nil) != tt.err || !slices.Equal(got, tt.want) {
+			t.Errorf("parsePointer(%q) = %q, %v, want %q, error %t", tt.pointer, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestArrayIndex(t *testing.T) {
+	tests := []struct {
+		token  string
+		length int
+		want   int
+		err    bool
+	}{
+		{"0", 1, 0, false},
+		{"10", 11, 10, false},
+		{"1", 1, 0, true},
+		{"01", 2, 0, true},
+		{"00", 2, 0, true},
+		{"-1", 2, 0, true},
+		{"-0", 2, 0, true},
+		{"+1", 2, 0, true},
+		{"-", 2, 0, true},
+		{"", 2, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := arrayIndex(tt.token, tt.length)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("arrayIndex(%q, %d) = %d, %v, want %d, error %t", tt.token, tt.length, got, err, tt.want, tt.err)
+		}
+	}
+}
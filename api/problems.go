@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// problemType is an entry of the error catalogue, its code is stable and meant
+// to be matched on by clients while titles and details are for humans.
+type problemType struct {
+	Code   string `json:"code"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+}
+
+// typeURI points at the entry in the catalogue of the API version.
+func (p problemType) typeURI(version string) string {
+	return "/" + version + "/problems/" + p.Code
+}
+
+// problemVersion returns the API version a problem is reported under, it's
+// the one of the request's path prefix and v1 outside of the versions.
+func problemVersion(r *http.Request) string {
+	if r != nil {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if n, ok := strings.CutPrefix(name, "v"); ok && n != "" && strings.Trim(n, "0123456789") == "" {
+			return name
+		}
+	}
+	return "v1"
+}
+
+var (
+	problemInternal                 = problemType{"internal_error", "Internal server error", http.StatusInternalServerError}
+	problemMalformedRequest         = problemType{"malformed_request", "Malformed request body", http.StatusBadRequest}
+	problemBodyTooLarge             = problemType{"body_too_large", "Request body too large", http.StatusRequestEntityTooLarge}
+	problemUnsupportedMediaType     = problemType{"unsupported_media_type", "Unsupported media type", http.StatusUnsupportedMediaType}
+	problemNotAcceptable            = problemType{"not_acceptable", "None of the acceptable media types can be produced", http.StatusNotAcceptable}
+	problemValidationFailed         = problemType{"validation_failed", "Request validation failed", http.StatusBadRequest}
+	problemInvalidPathParameter     = problemType{"invalid_path_parameter", "Invalid path parameter", http.StatusBadRequest}
+	problemInvalidAuthorization     = problemType{"invalid_authorization_header", "Invalid Authorization header", http.StatusUnauthorized}
+	problemInvalidToken             = problemType{"invalid_token", "Invalid or expired token", http.StatusUnauthorized}
+	problemInvalidRefreshToken      = problemType{"invalid_refresh_token", "Invalid or expired refresh token", http.StatusUnauthorized}
+	problemRefreshTokenReused       = problemType{"refresh_token_reused", "Refresh token was already used", http.StatusUnauthorized}
+	problemInvalidCredentials       = problemType{"invalid_credentials", "Email or password are not correct", http.StatusUnauthorized}
+	problemUnknownUser              = problemType{"unknown_user", "User no longer exists", http.StatusUnauthorized}
+	problemInvalidMagicLink         = problemType{"invalid_magic_link", "Invalid or expired magic link", http.StatusUnauthorized}
+	problemInvalidMFACode           = problemType{"invalid_mfa_code", "Two-factor code is not correct or was already used", http.StatusUnauthorized}
+	problemInsufficientScope        = problemType{"insufficient_scope", "Token lacks the required scope", http.StatusForbidden}
+	problemUserNotActivated         = problemType{"user_not_activated", "User account is not activated", http.StatusForbidden}
+	problemUserNotFound             = problemType{"user_not_found", "User doesn't exist", http.StatusNotFound}
+	problemUserExists               = problemType{"user_exists", "User already exists", http.StatusConflict}
+	problemEmailInUse               = problemType{"email_in_use", "Email is already in use", http.StatusConflict}
+	problemUserAlreadyActivated     = problemType{"user_already_activated", "User already activated", http.StatusConflict}
+	problemTOTPAlreadyEnabled       = problemType{"totp_already_enabled", "Two-factor authentication is already enabled", http.StatusConflict}
+	problemTOTPNotEnrolled          = problemType{"totp_not_enrolled", "Two-factor authentication isn't set up", http.StatusConflict}
+	problemActivationCodeRequired   = problemType{"activation_code_required", "Activation code must be provided", http.StatusBadRequest}
+	problemActivationCodeExpired    = problemType{"activation_code_expired", "Activation code has expired", http.StatusConflict}
+	problemInvalidActivationCode    = problemType{"invalid_activation_code", "Invalid activation code", http.StatusConflict}
+	problemInvalidPasswordReset     = problemType{"invalid_password_reset_token", "Invalid or expired password reset token", http.StatusBadRequest}
+	problemInvalidEmailChange       = problemType{"invalid_email_change_token", "Invalid or expired email change token", http.StatusBadRequest}
+	problemEmailChangeNotFound      = problemType{"email_change_not_found", "No email change is pending", http.StatusNotFound}
+	problemTaskNotFound             = problemType{"task_not_found", "Task doesn't exist", http.StatusNotFound}
+	problemTokenNotFound            = problemType{"token_not_found", "Token doesn't exist", http.StatusNotFound}
+	problemSessionNotFound          = problemType{"session_not_found", "Session doesn't exist", http.StatusNotFound}
+	problemFilterNotFound           = problemType{"filter_not_found", "Filter doesn't exist", http.StatusNotFound}
+	problemAccessDenied             = problemType{"access_denied", "Access denied", http.StatusConflict}
+	problemEditConflict             = problemType{"edit_conflict", "Edit conflict", http.StatusConflict}
+	problemPreconditionFailed       = problemType{"precondition_failed", "Precondition failed", http.StatusPreconditionFailed}
+	problemUnsupportedPatchType     = problemType{"unsupported_patch_type", "Unsupported patch media type", http.StatusUnsupportedMediaType}
+	problemInvalidPatch             = problemType{"invalid_patch", "Invalid patch document", http.StatusBadRequest}
+	problemPatchTestFailed          = problemType{"patch_test_failed", "Patch test operation failed", http.StatusConflict}
+	problemInvalidPatchResult       = problemType{"invalid_patch_result", "Patched document is invalid", http.StatusUnprocessableEntity}
+	problemIdempotencyKeyReused     = problemType{"idempotency_key_reused", "Idempotency key was used with a different request", http.StatusUnprocessableEntity}
+	problemIdempotencyKeyInProgress = problemType{"idempotency_key_in_progress", "A request with this idempotency key is in progress", http.StatusConflict}
+	problemIdempotencyUnsupported   = problemType{"idempotency_key_unsupported", "Route doesn't support idempotency keys", http.StatusBadRequest}
+	problemVersionRetired           = problemType{"version_retired", "API version has been retired", http.StatusGone}
+	problemRateLimitExceeded        = problemType{"rate_limit_exceeded", "Rate limit exceeded", http.StatusTooManyRequests}
+	problemTooManyFailedAttempts    = problemType{"too_many_failed_attempts", "Too many failed attempts", http.StatusTooManyRequests}
+	problemRequestSchemaViolation   = problemType{"request_schema_violation", "Request doesn't match the OpenAPI document", http.StatusBadRequest}
+	problemResponseSchemaViolation  = problemType{"response_schema_violation", "Response doesn't match the OpenAPI document", http.StatusInternalServerError}
+	problemProblemNotFound          = problemType{"problem_not_found", "Problem code doesn't exist", http.StatusNotFound}
+)
+
+var problemCatalogue = []problemType{
+	problemInternal,
+	problemMalformedRequest,
+	problemBodyTooLarge,
+	problemUnsupportedMediaType,
+	problemNotAcceptable,
+	problemValidationFailed,
+	problemInvalidPathParameter,
+	problemInvalidAuthorization,
+	problemInvalidToken,
+	problemInvalidRefreshToken,
+	problemRefreshTokenReused,
+	problemInvalidCredentials,
+	problemUnknownUser,
+	problemInvalidMagicLink,
+	problemInvalidMFACode,
+	problemInsufficientScope,
+	problemUserNotActivated,
+	problemUserNotFound,
+	problemUserExists,
+	problemEmailInUse,
+	problemUserAlreadyActivated,
+	problemTOTPAlreadyEnabled,
+	problemTOTPNotEnrolled,
+	problemActivationCodeRequired,
+	problemActivationCodeExpired,
+	problemInvalidActivationCode,
+	problemInvalidPasswordReset,
+	problemInvalidEmailChange,
+	problemEmailChangeNotFound,
+	problemTaskNotFound,
+	problemFilterNotFound,
+	problemSessionNotFound,
+	problemTokenNotFound,
+	problemAccessDenied,
+	problemEditConflict,
+	problemPreconditionFailed,
+	problemUnsupportedPatchType,
+	problemInvalidPatch,
+	problemPatchTestFailed,
+	problemInvalidPatchResult,
+	problemIdempotencyKeyReused,
+	problemIdempotencyKeyInProgress,
+	problemIdempotencyUnsupported,
+	problemVersionRetired,
+	problemRateLimitExceeded,
+	problemTooManyFailedAttempts,
+	problemRequestSchemaViolation,
+	problemResponseSchemaViolation,
+	problemProblemNotFound,
+}
+
+type fieldViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// problem is an RFC 9457 problem details object, extensions are serialized as
+// additional top-level members.
+type problem struct {
+	Type       string           `json:"type"`
+	Title      string           `json:"title"`
+	Status     int              `json:"status"`
+	Detail     string           `json:"detail,omitempty"`
+	Instance   string           `json:"instance,omitempty"`
+	Code       string           `json:"code"`
+	Errors     []fieldViolation `json:"errors,omitempty"`
+	Extensions map[string]any   `json:"-"`
+}
+
+func newProblem(r *http.Request, p problemType, detail string) *problem {
+	pr := &problem{
+		Type:   p.typeURI(problemVersion(r)),
+		Title:  p.Title,
+		Status: p.Status,
+		Detail: detail,
+		Code:   p.Code,
+	}
+	if r != nil {
+		pr.Instance = r.URL.Path
+	}
+	return pr
+}
+
+func (p *problem) MarshalJSON() ([]byte, error) {
+	type plain problem
+	data, err := json.Marshal((*plain)(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return data, err
+	}
+	m := make(map[string]any, len(p.Extensions))
+	maps.Copy(m, p.Extensions)
+	var members map[string]any
+	err = json.Unmarshal(data, &members)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(m, members)
+	return json.Marshal(m)
+}
+
+// writeProblem encodes the problem in the format negotiated from the Accept
+// header, JSON problems use the application/problem+json media type.
+func writeProblem(w http.ResponseWriter, r *http.Request, p *problem) {
+	c := negotiate(r)
+	if c == nil {
+		c = jsonCodec
+	}
+	data, err := c.encode(p)
+	if err != nil {
+		log.Println(err)
+		c = jsonCodec
+		data = []byte(`{"type":"` + problemInternal.typeURI(problemVersion(r)) + `","title":"Internal server error","status":500,"code":"internal_error"}`)
+		p.Status = http.StatusInternalServerError
+	}
+	if c == jsonCodec {
+		w.Header().Set("Content-Type", "application/problem+json")
+	} else {
+		w.Header().Set("Content-Type", c.mediaType)
+	}
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(p.Status)
+	w.Write(data)
+}
+
+// writeError responds with the problem's catalogue entry and a human readable
+// detail, r may be nil when the request isn't available.
+func writeError(w http.ResponseWriter, r *http.Request, p problemType, detail string) {
+	writeProblem(w, r, newProblem(r, p, detail))
+}
+
+// writeValidationError responds with the validator's field violations.
+func writeValidationError(w http.ResponseWriter, r *http.Request, p problemType, v *validator) {
+	pr := newProblem(r, p, "one or more fields are invalid")
+	pr.Errors = v.violations()
+	writeProblem(w, r, pr)
+}
+
+func (app *application) getProblemsHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, map[string]any{"problems": problemCatalogue}, http.StatusOK)
+}
+
+func (app *application) getProblemHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	i := slices.IndexFunc(problemCatalogue, func(p problemType) bool { return p.Code == code })
+	if i == -1 {
+		writeError(w, r, problemProblemNotFound, "no problem is registered with the code "+code)
+		return
+	}
+	writeResponse(w, r, map[string]any{"problem": problemCatalogue[i]}, http.StatusOK)
+}
@@ -4,28 +4,268 @@ import (
 	"net/http"
 )
 
+// route describes an endpoint relative to the version prefix, the mux and the
+// OpenAPI documents are all derived from the route table so they can't drift
+// apart. Personal access tokens need the route's scope, routes of
+// authenticated users without one only accept session tokens.
+type route struct {
+	method     string
+	path       string
+	summary    string
+	handler    http.HandlerFunc
+	auth       bool
+	scope      string
+	idempotent bool
+	query      []string
+	request    any
+	status     int
+	response   any
+}
+
 func composeRoutes(app *application) http.Handler {
+	app.mux = app.routes()
+
+	if app.config.limiter.enabled {
+		return app.enableCORS(app.rateLimit(app.mux))
+	}
+	return app.enableCORS(app.mux)
+}
+
+// routes registers every endpoint of every API version with its per-route
+// middlewares, the global middlewares are applied by composeRoutes.
+func (app *application) routes() *http.ServeMux {
 	mux := http.NewServeMux()
+	for _, v := range app.apiVersions() {
+		schemas := newSchemaBuilder(v.substitutes)
+		for _, rt := range app.routeTable() {
+			h := rt.handler
+			switch {
+			case rt.idempotent:
+				h = app.idempotent(h)
+			case rt.method == http.MethodPost:
+				// the POST routes that aren't idempotent hand out credentials
+				h = noStore(h)
+			}
+			if rt.auth {
+				h = app.requireAuthenticatedUser(requireActivatedUser(requireScope(rt.scope, h)))
+			}
+			h = app.transformVersion(v, rt, h)
+			if app.config.validateOpenAPI {
+				h = app.validateOpenAPI(schemas, rt, h)
+			}
+			if rt.response != nil {
+				h = requireAcceptable(h)
+			}
+			h = app.versioned(v, rt, h)
+			mux.HandleFunc(rt.method+" /"+v.name+rt.path, h)
+		}
+	}
+	// the key set lives at its well-known location, outside of the versions
+	mux.HandleFunc("GET /.well-known/jwks.json", app.getJWKSHandler)
+	return mux
+}
 
-	mux.HandleFunc("GET /v1/healthcheck", app.healthCheckHandler)
+func (app *application) routeTable() []route {
+	taskQuery := []string{"content", "sort", "is_completed", "created_after", "created_before", "ids", "page", "page_size", "fields", "expand"}
 
-	mux.HandleFunc("POST /v1/users/{id}/activation", app.sendActivationCodeHandler)
-	mux.HandleFunc("PUT /v1/users/{id}/activation", app.activateUserHandler)
-	mux.HandleFunc("POST /v1/users/authentication", app.authenticateUserHandler)
+	return []route{
+		{method: http.MethodGet, path: "/healthcheck", summary: "Report the API status", handler: app.healthCheckHandler,
+			status: http.StatusOK, response: healthCheck{}},
+		{method: http.MethodGet, path: "/problems", summary: "List the error catalogue", handler: app.getProblemsHandler,
+			status: http.StatusOK, response: struct {
+				Problems []problemType `json:"problems"`
+			}{}},
+		{method: http.MethodGet, path: "/problems/{code}", summary: "Describe an error code", handler: app.getProblemHandler,
+			status: http.StatusOK, response: struct {
+				Problem problemType `json:"problem"`
+			}{}},
+		{method: http.MethodGet, path: "/versions", summary: "List the API versions and their usage", handler: app.getVersionsHandler,
+			status: http.StatusOK, response: struct {
+				Versions []apiVersionInfo `json:"versions"`
+			}{}},
+		{method: http.MethodGet, path: "/openapi.json", summary: "Serve this OpenAPI document", handler: app.getOpenAPIHandler,
+			status: http.StatusOK, response: map[string]any{}},
+		{method: http.MethodGet, path: "/docs", summary: "Browse the API documentation", handler: app.getDocsHandler,
+			status: http.StatusOK},
 
-	mux.HandleFunc("POST /v1/users", app.createUserHandler)
-	mux.HandleFunc("PUT /v1/users", app.requireAuthenticatedUser(requireActivatedUser(app.updateUserHandler)))
-	mux.HandleFunc("GET /v1/users", app.requireAuthenticatedUser(requireActivatedUser(app.getUserHandler)))
-	mux.HandleFunc("DELETE /v1/users", app.requireAuthenticatedUser(requireActivatedUser(app.deleteUserHandler)))
+		{method: http.MethodPost, path: "/users/{id}/activation", summary: "Send an activation code", handler: app.sendActivationCodeHandler,
+			idempotent: true, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodPut, path: "/users/{id}/activation", summary: "Activate a user", handler: app.activateUserHandler,
+			request: activateUserInput{}, status: http.StatusOK, response: struct {
+				User user `json:"user"`
+			}{}},
+		{method: http.MethodPost, path: "/users/password-reset", summary: "Email a password reset token", handler: app.requestPasswordResetHandler,
+			idempotent: true, request: requestPasswordResetInput{}, status: http.StatusAccepted, response: struct {
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodPut, path: "/users/password-reset", summary: "Set a new password with a reset token", handler: app.resetPasswordHandler,
+			request: resetPasswordInput{}, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodPut, path: "/users/email-change/confirmation", summary: "Confirm a new email with its token", handler: app.confirmEmailChangeHandler,
+			request: confirmEmailChangeInput{}, status: http.StatusOK, response: struct {
+				User user `json:"user"`
+			}{}},
+		{method: http.MethodPost, path: "/users/authentication", summary: "Issue an authentication token", handler: app.authenticateUserHandler,
+			request: authenticateUserInput{}, status: http.StatusCreated, response: authTokens{}},
+		{method: http.MethodPost, path: "/users/magic-link", summary: "Email a sign-in token", handler: app.requestMagicLinkHandler,
+			idempotent: true, request: requestMagicLinkInput{}, status: http.StatusAccepted, response: struct {
+				Nonce   string `json:"nonce"`
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodPost, path: "/users/magic-link/verify", summary: "Issue an authentication token for a sign-in token", handler: app.verifyMagicLinkHandler,
+			request: verifyMagicLinkInput{}, status: http.StatusCreated, response: authTokens{}},
+		{method: http.MethodPost, path: "/users/authentication/2fa", summary: "Complete a sign-in with a two-factor code", handler: app.verifyMFAHandler,
+			request: verifyMFAInput{}, status: http.StatusCreated, response: authTokens{}},
+		{method: http.MethodPost, path: "/tokens/refresh", summary: "Rotate a refresh token for new tokens", handler: app.refreshTokenHandler,
+			request: refreshTokenInput{}, status: http.StatusCreated, response: authTokens{}},
 
-	mux.HandleFunc("POST /v1/tasks", app.requireAuthenticatedUser(requireActivatedUser(app.createTaskHandler)))
-	mux.HandleFunc("PUT /v1/tasks/{id}", app.requireAuthenticatedUser(requireActivatedUser(app.updateTaskHandler)))
-	mux.HandleFunc("GET /v1/tasks", app.requireAuthenticatedUser(requireActivatedUser(app.getTasksHandler)))
-	mux.HandleFunc("GET /v1/tasks/{id}", app.requireAuthenticatedUser(requireActivatedUser(app.getTaskHandler)))
-	mux.HandleFunc("DELETE /v1/tasks/{id}", app.requireAuthenticatedUser(requireActivatedUser(app.deleteTaskHandler)))
+		{method: http.MethodPost, path: "/users/logout", summary: "Revoke the token of the request", handler: app.logoutHandler,
+			auth: true, idempotent: true, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodPost, path: "/users/logout/all", summary: "Revoke every token of the authenticated user", handler: app.logoutEverywhereHandler,
+			auth: true, idempotent: true, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
 
-	if app.config.limiter.enabled {
-		return app.enableCORS(app.rateLimit(mux))
+		{method: http.MethodGet, path: "/users/sessions", summary: "List the sessions of the authenticated user", handler: app.getSessionsHandler,
+			auth: true, status: http.StatusOK, response: struct {
+				Sessions []session `json:"sessions"`
+			}{}},
+		{method: http.MethodDelete, path: "/users/sessions/{id}", summary: "Revoke a session", handler: app.deleteSessionHandler,
+			auth: true, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+
+		{method: http.MethodGet, path: "/users/email-change", summary: "Get the pending email change", handler: app.getEmailChangeHandler,
+			auth: true, scope: "user:read", status: http.StatusOK, response: struct {
+				EmailChange emailChange `json:"email_change"`
+			}{}},
+		{method: http.MethodDelete, path: "/users/email-change", summary: "Cancel the pending email change", handler: app.cancelEmailChangeHandler,
+			auth: true, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+
+		{method: http.MethodPost, path: "/users/2fa/totp", summary: "Enrol an authenticator app", handler: app.enrolTOTPHandler,
+			auth: true, request: passwordInput{}, status: http.StatusCreated, response: totpEnrolment{}},
+		{method: http.MethodPost, path: "/users/2fa/totp/confirmation", summary: "Enable two-factor authentication with a first code", handler: app.confirmTOTPHandler,
+			auth: true, request: totpCodeInput{}, status: http.StatusCreated, response: struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			}{}},
+		{method: http.MethodDelete, path: "/users/2fa/totp", summary: "Disable two-factor authentication", handler: app.disableTOTPHandler,
+			auth: true, request: passwordInput{}, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodPost, path: "/users/2fa/recovery-codes", summary: "Replace the recovery codes", handler: app.regenerateRecoveryCodesHandler,
+			auth: true, request: passwordInput{}, status: http.StatusCreated, response: struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			}{}},
+
+		{method: http.MethodPost, path: "/users/tokens", summary: "Create a personal access token", handler: app.createPersonalAccessTokenHandler,
+			auth: true, request: createPersonalAccessTokenInput{}, status: http.StatusCreated, response: struct {
+				Token  personalAccessToken `json:"token"`
+				Secret string              `json:"secret"`
+			}{}},
+		{method: http.MethodGet, path: "/users/tokens", summary: "List the personal access tokens of the authenticated user", handler: app.getPersonalAccessTokensHandler,
+			auth: true, status: http.StatusOK, response: struct {
+				Tokens []personalAccessToken `json:"tokens"`
+			}{}},
+		{method: http.MethodDelete, path: "/users/tokens/{id}", summary: "Revoke a personal access token", handler: app.deletePersonalAccessTokenHandler,
+			auth: true, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+
+		{method: http.MethodPost, path: "/users", summary: "Register a user", handler: app.createUserHandler,
+			idempotent: true, request: createUserInput{}, status: http.StatusCreated, response: struct {
+				User    user   `json:"user"`
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodPut, path: "/users", summary: "Replace the authenticated user", handler: app.updateUserHandler,
+			auth: true, request: updateUserInput{}, status: http.StatusOK, response: struct {
+				User        user         `json:"user"`
+				EmailChange *emailChange `json:"email_change,omitempty"`
+			}{}},
+		{method: http.MethodPatch, path: "/users", summary: "Patch the authenticated user", handler: app.patchUserHandler,
+			auth: true, status: http.StatusOK, response: struct {
+				User        user         `json:"user"`
+				EmailChange *emailChange `json:"email_change,omitempty"`
+			}{}},
+		{method: http.MethodGet, path: "/users", summary: "Get the authenticated user", handler: app.getUserHandler,
+			auth: true, scope: "user:read", status: http.StatusOK, response: struct {
+				User user `json:"user"`
+			}{}},
+		{method: http.MethodDelete, path: "/users", summary: "Delete the authenticated user", handler: app.deleteUserHandler,
+			auth: true, status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+
+		{method: http.MethodPost, path: "/tasks", summary: "Create a task", handler: app.createTaskHandler,
+			auth: true, scope: "tasks:write", idempotent: true, request: createTaskInput{}, status: http.StatusCreated, response: struct {
+				Task task `json:"task"`
+			}{}},
+		{method: http.MethodPut, path: "/tasks/{id}", summary: "Replace a task", handler: app.updateTaskHandler,
+			auth: true, scope: "tasks:write", request: updateTaskInput{}, status: http.StatusOK, response: struct {
+				Task task `json:"task"`
+			}{}},
+		{method: http.MethodPatch, path: "/tasks/{id}", summary: "Patch a task", handler: app.patchTaskHandler,
+			auth: true, scope: "tasks:write", status: http.StatusOK, response: struct {
+				Task task `json:"task"`
+			}{}},
+		{method: http.MethodGet, path: "/tasks", summary: "List tasks", handler: app.getTasksHandler,
+			auth: true, scope: "tasks:read", query: taskQuery, status: http.StatusOK, response: struct {
+				Tasks    []task      `json:"tasks"`
+				Total    int         `json:"total"`
+				Metadata metadata    `json:"metadata"`
+				Counts   *taskCounts `json:"counts,omitempty"`
+			}{}},
+		{method: http.MethodGet, path: "/tasks/stats", summary: "Summarize tasks", handler: app.getTaskStatsHandler,
+			auth: true, scope: "tasks:read", query: []string{"interval", "from", "to"}, status: http.StatusOK, response: struct {
+				Stats taskStats `json:"stats"`
+			}{}},
+		{method: http.MethodGet, path: "/tasks/{id}", summary: "Get a task", handler: app.getTaskHandler,
+			auth: true, scope: "tasks:read", query: []string{"fields", "expand"}, status: http.StatusOK, response: struct {
+				Task   task        `json:"task"`
+				Counts *taskCounts `json:"counts,omitempty"`
+			}{}},
+		{method: http.MethodDelete, path: "/tasks/{id}", summary: "Delete a task", handler: app.deleteTaskHandler,
+			auth: true, scope: "tasks:write", status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+
+		{method: http.MethodPost, path: "/filters", summary: "Save a filter", handler: app.createFilterHandler,
+			auth: true, scope: "tasks:write", idempotent: true, request: createFilterInput{}, status: http.StatusCreated, response: struct {
+				Filter savedFilter `json:"filter"`
+			}{}},
+		{method: http.MethodGet, path: "/filters", summary: "List saved filters", handler: app.getFiltersHandler,
+			auth: true, scope: "tasks:read", query: []string{"with_counts"}, status: http.StatusOK, response: struct {
+				Filters []savedFilter `json:"filters"`
+			}{}},
+		{method: http.MethodGet, path: "/filters/{id}", summary: "Get a saved filter", handler: app.getFilterHandler,
+			auth: true, scope: "tasks:read", query: []string{"with_counts"}, status: http.StatusOK, response: struct {
+				Filter savedFilter `json:"filter"`
+			}{}},
+		{method: http.MethodPut, path: "/filters/{id}", summary: "Update a saved filter", handler: app.updateFilterHandler,
+			auth: true, scope: "tasks:write", request: updateFilterInput{}, status: http.StatusOK, response: struct {
+				Filter savedFilter `json:"filter"`
+			}{}},
+		{method: http.MethodDelete, path: "/filters/{id}", summary: "Delete a saved filter", handler: app.deleteFilterHandler,
+			auth: true, scope: "tasks:write", status: http.StatusOK, response: struct {
+				Message string `json:"message"`
+			}{}},
+		{method: http.MethodGet, path: "/filters/{id}/tasks", summary: "List the tasks matching a saved filter", handler: app.getFilterTasksHandler,
+			auth: true, scope: "tasks:read", query: []string{"page", "page_size"}, status: http.StatusOK, response: struct {
+				Tasks    []task   `json:"tasks"`
+				Total    int      `json:"total"`
+				Metadata metadata `json:"metadata"`
+			}{}},
+
+		{method: http.MethodPost, path: "/batch", summary: "Dispatch several requests at once", handler: app.batchHandler,
+			idempotent: true, request: batchInput{}, status: http.StatusOK, response: struct {
+				Responses []batchResponse `json:"responses"`
+				Committed bool            `json:"committed"`
+			}{}},
 	}
-	return app.enableCORS(mux)
 }
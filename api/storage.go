@@ -3,13 +3,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+)
+
+var (
+	errEditConflict   = errors.New("edit conflict")
+	errDuplicateEmail = errors.New("duplicate email")
 )
 
 func openDB(cfg config) (*sql.DB, error) {
@@ -33,8 +41,13 @@ func openDB(cfg config) (*sql.DB, error) {
 	return db, nil
 }
 
+// maxActivationAttempts is how many wrong codes invalidate an activation code,
+// a uint16 code would otherwise be guessed in a few thousand requests.
+const maxActivationAttempts = 5
+
 type userActivationCacheEntry struct {
 	code      uint16
+	attempts  int
 	expiresAt time.Time
 }
 
@@ -84,6 +97,24 @@ func (c *userActivationCache) Get(u *user) (int, bool) {
 	return int(e.code), time.Now().After(e.expiresAt)
 }
 
+// Fail records a wrong code for the user and returns how many attempts are
+// left, the code is invalidated once none are.
+func (c *userActivationCache) Fail(u *user) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[u.ID]
+	if !ok {
+		return 0
+	}
+	e.attempts++
+	if e.attempts >= maxActivationAttempts {
+		delete(c.entries, u.ID)
+		return 0
+	}
+	c.entries[u.ID] = e
+	return maxActivationAttempts - e.attempts
+}
+
 func (c *userActivationCache) Clear(u *user) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -97,27 +128,156 @@ func (c *userActivationCache) HasExpired(u *user) bool {
 	return !ok || time.Now().After(e.expiresAt)
 }
 
+// dbtx is satisfied by both *sql.DB and *sql.Tx so that storage methods can run
+// inside a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// revokedTokenCache mirrors the unexpired rows of revoked_tokens so that
+// authenticating a request doesn't need a query, it's synced periodically to
+// pick up tokens revoked by other instances.
+type revokedTokenCache struct {
+	mu       sync.RWMutex
+	entries  map[string]time.Time
+	syncedAt time.Time
+}
+
+func newRevokedTokenCache() *revokedTokenCache {
+	return &revokedTokenCache{
+		entries: make(map[string]time.Time),
+	}
+}
+
+func (c *revokedTokenCache) Set(jti string, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[jti] = expiresAt
+}
+
+func (c *revokedTokenCache) Has(jti string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.entries[jti]
+	return ok
+}
+
 type storage struct {
-	db                  *sql.DB
+	db                  dbtx
+	pool                *sql.DB
 	useractivationCache *userActivationCache
+	revokedTokens       *revokedTokenCache
+	// tx is set on storages bound to a transaction, afterCommit holds the
+	// cache updates that wait for it to commit
+	tx          *sql.Tx
+	afterCommit []func()
 }
 
 func newStorage(db *sql.DB) *storage {
-	return &storage{
+	s := &storage{
 		db:                  db,
+		pool:                db,
 		useractivationCache: newUserActivationCache(),
+		revokedTokens:       newRevokedTokenCache(),
+	}
+	go func(s *storage) {
+		ticker := time.NewTicker(30 * time.Second)
+		for {
+			err := s.syncRevokedTokens()
+			if err != nil {
+				log.Println(err)
+			}
+			<-ticker.C
+		}
+	}(s)
+	go func(s *storage) {
+		ticker := time.NewTicker(time.Hour)
+		for {
+			<-ticker.C
+			err := s.deleteExpiredIdempotencyKeys()
+			if err != nil {
+				log.Println(err)
+			}
+			err = s.deleteExpiredRefreshTokens()
+			if err != nil {
+				log.Println(err)
+			}
+			err = s.deleteExpiredRevokedTokens()
+			if err != nil {
+				log.Println(err)
+			}
+			err = s.deleteExpiredPasswordResetTokens()
+			if err != nil {
+				log.Println(err)
+			}
+			err = s.deleteExpiredEmailChanges()
+			if err != nil {
+				log.Println(err)
+			}
+			err = s.deleteExpiredMagicLinks()
+			if err != nil {
+				log.Println(err)
+			}
+			err = s.deleteStaleAuthFailures()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}(s)
+	return s
+}
+
+func (s *storage) beginTx(ctx context.Context) (*sql.Tx, error) {
+	return s.pool.BeginTx(ctx, nil)
+}
+
+// withTx returns a copy of the storage whose queries run inside tx.
+func (s *storage) withTx(tx *sql.Tx) *storage {
+	return &storage{
+		db:                  tx,
+		pool:                s.pool,
+		useractivationCache: s.useractivationCache,
+		revokedTokens:       s.revokedTokens,
+		tx:                  tx,
+	}
+}
+
+// onCommit runs f once the storage's transaction has committed, or right away
+// when it isn't bound to one. The caches are shared by every request, updating
+// them through it keeps a rolled back transaction from leaking into them.
+func (s *storage) onCommit(f func()) {
+	if s.tx == nil {
+		f()
+		return
+	}
+	s.afterCommit = append(s.afterCommit, f)
+}
+
+// commit commits the storage's transaction and applies the updates that were
+// waiting for it.
+func (s *storage) commit() error {
+	err := s.tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, f := range s.afterCommit {
+		f()
 	}
+	s.afterCommit = nil
+	return nil
 }
 
 func (s *storage) getUserByEmail(email string) (*user, error) {
-	query := `SELECT id, created_at, name, email, password_hash, is_activated, version
+	query := `SELECT id, created_at, name, email, password_hash, is_activated, updated_at, version, credential_version
 			  FROM users
 			  where email = $1`
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	row := s.db.QueryRowContext(ctx, query, email)
 	var u user
-	err := row.Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Version)
+	err := row.Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.UpdatedAt, &u.Version, &u.CredentialVersion)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -130,14 +290,14 @@ func (s *storage) getUserByEmail(email string) (*user, error) {
 }
 
 func (s *storage) getUserByID(id int) (*user, error) {
-	query := `SELECT id, created_at, name, email, password_hash, is_activated, version
+	query := `SELECT id, created_at, name, email, password_hash, is_activated, updated_at, version, credential_version
 			  FROM users
 			  where id = $1`
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	row := s.db.QueryRowContext(ctx, query, id)
 	var u user
-	err := row.Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.Version)
+	err := row.Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.PasswordHash, &u.IsActivated, &u.UpdatedAt, &u.Version, &u.CredentialVersion)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -152,60 +312,119 @@ func (s *storage) getUserByID(id int) (*user, error) {
 func (s *storage) insertUser(u *user) error {
 	query := `INSERT INTO users (name, email, password_hash, is_activated)
 			  VALUES ($1, $2, $3, $4)
-			  RETURNING id, created_at, version`
+			  RETURNING id, created_at, updated_at, version, credential_version`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	row := s.db.QueryRowContext(ctx, query, u.Name, u.Email, u.PasswordHash, u.IsActivated)
-	err := row.Scan(&u.ID, &u.CreatedAt, &u.Version)
+	err := row.Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt, &u.Version, &u.CredentialVersion)
 	return err
 }
 
 func (s *storage) updateUser(u *user) error {
-	query := `UPDATE users SET name = $1, email = $2, password_hash = $3, is_activated = $4, version = version + 1
-			  WHERE id = $5 and version = $6
-			  RETURNING version`
+	query := `UPDATE users SET name = $1, email = $2, password_hash = $3, is_activated = $4, credential_version = $5, updated_at = NOW(), version = version + 1
+			  WHERE id = $6 and version = $7
+			  RETURNING updated_at, version`
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	row := s.db.QueryRowContext(ctx, query, u.Name, u.Email, u.PasswordHash, u.IsActivated, u.ID, u.Version)
-	err := row.Scan(&u.Version)
+	row := s.db.QueryRowContext(ctx, query, u.Name, u.Email, u.PasswordHash, u.IsActivated, u.CredentialVersion, u.ID, u.Version)
+	err := row.Scan(&u.UpdatedAt, &u.Version)
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return errEditConflict
+	case errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "users_email_key":
+		return errDuplicateEmail
+	}
 	return err
 }
 
 func (s *storage) deleteUser(u *user) error {
 	query := `DELETE FROM users
-			  WHERE id = $1`
+			  WHERE id = $1 AND version = $2`
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx, query, u.ID)
-	return err
+	result, err := s.db.ExecContext(ctx, query, u.ID, u.Version)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errEditConflict
+	}
+	return nil
 }
 
 func (s *storage) insertTask(u *user, t *task) error {
 	query := `INSERT INTO tasks (user_id, content, is_completed)
 			  VALUES ($1, $2, $3)
-			  RETURNING id, created_at, version`
+			  RETURNING id, created_at, updated_at, version`
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err := s.db.QueryRowContext(ctx, query, u.ID, t.Content, t.IsCompleted).Scan(&t.ID, &t.CreatedAt, &t.Version)
+	err := s.db.QueryRowContext(ctx, query, u.ID, t.Content, t.IsCompleted).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt, &t.Version)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *storage) getTaskByID(id int) (*task, error) {
-	query := `SELECT created_at, user_id, content, is_completed, version
+var taskColumns = []string{"id", "created_at", "user_id", "content", "is_completed", "completed_at", "updated_at", "version"}
+
+// selectTaskColumns returns the columns needed to serve the requested fields,
+// id, user_id, updated_at and version are always selected since handlers
+// depend on them.
+func selectTaskColumns(fields []string) []string {
+	if len(fields) == 0 {
+		return taskColumns
+	}
+	columns := []string{"id", "user_id", "updated_at", "version"}
+	for _, f := range fields {
+		if !slices.Contains(columns, f) {
+			columns = append(columns, f)
+		}
+	}
+	return columns
+}
+
+func taskScanTargets(t *task, columns []string) []any {
+	targets := make([]any, 0, len(columns))
+	for _, c := range columns {
+		switch c {
+		case "id":
+			targets = append(targets, &t.ID)
+		case "created_at":
+			targets = append(targets, &t.CreatedAt)
+		case "user_id":
+			targets = append(targets, &t.UserID)
+		case "content":
+			targets = append(targets, &t.Content)
+		case "is_completed":
+			targets = append(targets, &t.IsCompleted)
+		case "completed_at":
+			targets = append(targets, &t.CompletedAt)
+		case "updated_at":
+			targets = append(targets, &t.UpdatedAt)
+		case "version":
+			targets = append(targets, &t.Version)
+		}
+	}
+	return targets
+}
+
+func (s *storage) getTaskByID(id int, fields ...string) (*task, error) {
+	columns := selectTaskColumns(fields)
+	query := fmt.Sprintf(`SELECT %s
 			  FROM tasks
-			  WHERE id = $1`
+			  WHERE id = $1`, strings.Join(columns, ", "))
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	t := &task{
-		ID: id,
-	}
-	err := s.db.QueryRowContext(ctx, query, id).Scan(&t.CreatedAt, &t.UserID, &t.Content, &t.IsCompleted, &t.Version)
+	t := &task{}
+	err := s.db.QueryRowContext(ctx, query, id).Scan(taskScanTargets(t, columns)...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -217,7 +436,41 @@ func (s *storage) getTaskByID(id int) (*task, error) {
 	return t, err
 }
 
-func (s *storage) getTasksForUser(u *user, sort string, page, pageSize int, content string) ([]task, int, error) {
+func taskFilterConditions(u *user, f taskFilter) ([]string, []any) {
+	conds := []string{"user_id = $1"}
+	args := []any{u.ID}
+	if f.Content != "" {
+		args = append(args, f.Content)
+		conds = append(conds, fmt.Sprintf("to_tsvector('simple', content) @@ plainto_tsquery('simple', $%d)", len(args)))
+	}
+	if f.IsCompleted != nil {
+		args = append(args, *f.IsCompleted)
+		conds = append(conds, fmt.Sprintf("is_completed = $%d", len(args)))
+	}
+	if f.CreatedAfter != nil {
+		args = append(args, *f.CreatedAfter)
+		conds = append(conds, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if f.CreatedBefore != nil {
+		args = append(args, *f.CreatedBefore)
+		conds = append(conds, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if len(f.IDs) != 0 {
+		ids := make([]int64, len(f.IDs))
+		for i, id := range f.IDs {
+			ids[i] = int64(id)
+		}
+		args = append(args, pq.Array(ids))
+		conds = append(conds, fmt.Sprintf("id = ANY($%d)", len(args)))
+	}
+	return conds, args
+}
+
+func (s *storage) getTasksForUser(u *user, f taskFilter, page, pageSize int, fields ...string) ([]task, int, error) {
+	sort := f.Sort
+	if sort == "" {
+		sort = "id"
+	}
 	order := "ASC"
 	if strings.HasPrefix(sort, "-") {
 		order = "DESC"
@@ -229,26 +482,27 @@ func (s *storage) getTasksForUser(u *user, sort string, page, pageSize int, cont
 	}
 	limit := pageSize
 	offset := (page - 1) * pageSize
-	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, content, is_completed, version
+	conds, args := taskFilterConditions(u, f)
+	args = append(args, limit, offset)
+	columns := selectTaskColumns(fields)
+	query := fmt.Sprintf(`SELECT count(*) OVER(), %s
 			  FROM tasks
-			  WHERE user_id = $1 AND ($2 = '' OR to_tsvector('simple', content) @@ plainto_tsquery('simple', $2))
+			  WHERE %s
 			  ORDER BY %s
-			  LIMIT $3 OFFSET $4`, sortStr)
+			  LIMIT $%d OFFSET $%d`, strings.Join(columns, ", "), strings.Join(conds, " AND "), sortStr, len(args)-1, len(args))
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	tasks := make([]task, 0)
-	rows, err := s.db.QueryContext(ctx, query, u.ID, content, limit, offset)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer rows.Close()
 	total := 0
 	for rows.Next() {
-		t := task{
-			UserID: u.ID,
-		}
-		err = rows.Scan(&total, &t.ID, &t.CreatedAt, &t.Content, &t.IsCompleted, &t.Version)
+		var t task
+		err = rows.Scan(append([]any{&total}, taskScanTargets(&t, columns)...)...)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -257,33 +511,1032 @@ func (s *storage) getTasksForUser(u *user, sort string, page, pageSize int, cont
 	if err := rows.Err(); err != nil {
 		return nil, 0, err
 	}
+	// the window count comes with the rows, a page past the end has none
+	if len(tasks) == 0 && offset > 0 {
+		query = fmt.Sprintf(`SELECT count(*)
+				 FROM tasks
+				 WHERE %s`, strings.Join(conds, " AND "))
+		err = s.db.QueryRowContext(ctx, query, args[:len(args)-2]...).Scan(&total)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 	return tasks, total, nil
 }
 
+// getTasksStateForUser returns the number of tasks matching the filter, the
+// sum of their versions and the latest time any of them was modified. The
+// versions catch edits within the same second and edits of older tasks, which
+// the second precision modification time alone misses.
+func (s *storage) getTasksStateForUser(u *user, f taskFilter) (int, int, time.Time, error) {
+	conds, args := taskFilterConditions(u, f)
+	query := fmt.Sprintf(`SELECT count(*), COALESCE(sum(version), 0), max(updated_at)
+			  FROM tasks
+			  WHERE %s`, strings.Join(conds, " AND "))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, versions := 0, 0
+	var lastModified sql.NullTime
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&count, &versions, &lastModified)
+	return count, versions, lastModified.Time, err
+}
+
+func (s *storage) countTasksByState(u *user) (int, int, error) {
+	query := `SELECT count(*) FILTER (WHERE NOT is_completed), count(*) FILTER (WHERE is_completed)
+			  FROM tasks
+			  WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	open, completed := 0, 0
+	err := s.db.QueryRowContext(ctx, query, u.ID).Scan(&open, &completed)
+	return open, completed, err
+}
+
+func (s *storage) getTaskStats(u *user, interval string, from, to time.Time) (*taskStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stats := &taskStats{
+		Interval: interval,
+		Series:   make([]taskStatsBucket, 0),
+	}
+	// tasks completed before completed_at was tracked have it NULL, which the
+	// average and the completion buckets leave out
+	query := `SELECT count(*) FILTER (WHERE NOT is_completed),
+			         count(*) FILTER (WHERE is_completed),
+			         COALESCE(EXTRACT(EPOCH FROM avg(completed_at - created_at)), 0)
+			  FROM tasks
+			  WHERE user_id = $1`
+	err := s.db.QueryRowContext(ctx, query, u.ID).Scan(&stats.Open, &stats.Completed, &stats.AverageCompletionSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	query = fmt.Sprintf(`SELECT %s
+			  FROM tasks
+			  WHERE user_id = $1 AND NOT is_completed
+			  ORDER BY created_at ASC, id ASC
+			  LIMIT 1`, strings.Join(taskColumns, ", "))
+	var oldest task
+	err = s.db.QueryRowContext(ctx, query, u.ID).Scan(taskScanTargets(&oldest, taskColumns)...)
+	switch {
+	case err == nil:
+		stats.OldestOpenTask = &oldest
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	query = `WITH buckets AS (
+				  SELECT generate_series(date_trunc($2::text, $3::timestamptz), date_trunc($2::text, $4::timestamptz - interval '1 second'), ('1 ' || $2::text)::interval) AS bucket
+			  ), created AS (
+				  SELECT date_trunc($2::text, created_at) AS bucket, count(*) AS n
+				  FROM tasks
+				  WHERE user_id = $1 AND created_at >= $3 AND created_at < $4
+				  GROUP BY 1
+			  ), completed AS (
+				  SELECT date_trunc($2::text, completed_at) AS bucket, count(*) AS n
+				  FROM tasks
+				  WHERE user_id = $1 AND completed_at >= $3 AND completed_at < $4
+				  GROUP BY 1
+			  )
+			  SELECT b.bucket, COALESCE(cr.n, 0), COALESCE(co.n, 0)
+			  FROM buckets b
+			  LEFT JOIN created cr ON cr.bucket = b.bucket
+			  LEFT JOIN completed co ON co.bucket = b.bucket
+			  ORDER BY b.bucket ASC`
+	rows, err := s.db.QueryContext(ctx, query, u.ID, interval, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b taskStatsBucket
+		err = rows.Scan(&b.Start, &b.Created, &b.Completed)
+		if err != nil {
+			return nil, err
+		}
+		stats.Series = append(stats.Series, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (s *storage) countTasksForUserSince(u *user, f taskFilter, since time.Time) (int, error) {
+	conds, args := taskFilterConditions(u, f)
+	args = append(args, since)
+	conds = append(conds, fmt.Sprintf("created_at > $%d", len(args)))
+	query := fmt.Sprintf(`SELECT count(*)
+			  FROM tasks
+			  WHERE %s`, strings.Join(conds, " AND "))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count := 0
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
 func (s *storage) updateTask(t *task) error {
 	query := `UPDATE tasks
-	          SET content = $1, is_completed = $2, version = version + 1
+	          SET content = $1, is_completed = $2, updated_at = NOW(), version = version + 1,
+			      completed_at = CASE WHEN NOT $2 THEN NULL WHEN is_completed THEN completed_at ELSE NOW() END
 			  WHERE id = $3 AND version = $4
-			  RETURNING version`
+			  RETURNING version, completed_at, updated_at`
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := s.db.QueryRowContext(ctx, query, t.Content, t.IsCompleted, t.ID, t.Version).Scan(&t.Version)
+	err := s.db.QueryRowContext(ctx, query, t.Content, t.IsCompleted, t.ID, t.Version).Scan(&t.Version, &t.CompletedAt, &t.UpdatedAt)
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return errEditConflict
+		default:
+			return err
+		}
 	}
 	return nil
 }
 
 func (s *storage) deleteTask(t *task) error {
 	query := `DELETE FROM tasks
-	          WHERE id = $1`
+	          WHERE id = $1 AND version = $2`
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := s.db.ExecContext(ctx, query, t.ID)
+	result, err := s.db.ExecContext(ctx, query, t.ID, t.Version)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return errEditConflict
+	}
 	return nil
 }
+
+func (s *storage) insertFilter(u *user, f *savedFilter) error {
+	query := `INSERT INTO filters (user_id, name, query)
+			  VALUES ($1, $2, $3)
+			  RETURNING id, created_at, last_viewed_at, version`
+	data, err := json.Marshal(f.Filter)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, u.ID, f.Name, data).Scan(&f.ID, &f.CreatedAt, &f.LastViewedAt, &f.Version)
+}
+
+func (s *storage) getFilterByID(id int) (*savedFilter, error) {
+	query := `SELECT created_at, user_id, name, query, last_viewed_at, version
+			  FROM filters
+			  WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f := &savedFilter{
+		ID: id,
+	}
+	var data []byte
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&f.CreatedAt, &f.UserID, &f.Name, &data, &f.LastViewedAt, &f.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	err = json.Unmarshal(data, &f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *storage) getFiltersForUser(u *user) ([]savedFilter, error) {
+	query := `SELECT id, created_at, name, query, last_viewed_at, version
+			  FROM filters
+			  WHERE user_id = $1
+			  ORDER BY id ASC`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filters := make([]savedFilter, 0)
+	rows, err := s.db.QueryContext(ctx, query, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := savedFilter{
+			UserID: u.ID,
+		}
+		var data []byte
+		err = rows.Scan(&f.ID, &f.CreatedAt, &f.Name, &data, &f.LastViewedAt, &f.Version)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &f.Filter)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+func (s *storage) updateFilter(f *savedFilter) error {
+	query := `UPDATE filters
+			  SET name = $1, query = $2, version = version + 1
+			  WHERE id = $3 AND version = $4
+			  RETURNING version`
+	data, err := json.Marshal(f.Filter)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.db.QueryRowContext(ctx, query, f.Name, data, f.ID, f.Version).Scan(&f.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errEditConflict
+	}
+	return err
+}
+
+// touchFilter records that the filter's results were viewed, it leaves the
+// version alone as viewing isn't an edit.
+func (s *storage) touchFilter(f *savedFilter) error {
+	query := `UPDATE filters SET last_viewed_at = NOW()
+			  WHERE id = $1
+			  RETURNING last_viewed_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, f.ID).Scan(&f.LastViewedAt)
+}
+
+func (s *storage) deleteFilter(f *savedFilter) error {
+	query := `DELETE FROM filters
+			  WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, f.ID)
+	return err
+}
+
+// lockIdempotencyKey claims the key for an in-flight request, it reports false
+// when the key is already held by a live request or a stored response. Expired
+// keys and requests abandoned for over a minute are taken over.
+func (s *storage) lockIdempotencyKey(rec *idempotencyRecord) (bool, error) {
+	query := `INSERT INTO idempotency_keys (user_id, key, expires_at, fingerprint)
+			  VALUES ($1, $2, $3, $4)
+			  ON CONFLICT (user_id, key) DO UPDATE
+			  SET created_at = NOW(), expires_at = EXCLUDED.expires_at, fingerprint = EXCLUDED.fingerprint,
+			      status_code = NULL, header = NULL, body = NULL
+			  WHERE idempotency_keys.expires_at < NOW()
+			     OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < NOW() - interval '1 minute')
+			  RETURNING key`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var key string
+	err := s.db.QueryRowContext(ctx, query, rec.UserID, rec.Key, rec.ExpiresAt, rec.Fingerprint).Scan(&key)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (s *storage) getIdempotencyKey(userID int, key string) (*idempotencyRecord, error) {
+	query := `SELECT expires_at, fingerprint, status_code, header, body
+			  FROM idempotency_keys
+			  WHERE user_id = $1 AND key = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rec := &idempotencyRecord{
+		UserID: userID,
+		Key:    key,
+	}
+	var statusCode sql.NullInt64
+	var header []byte
+	err := s.db.QueryRowContext(ctx, query, userID, key).Scan(&rec.ExpiresAt, &rec.Fingerprint, &statusCode, &header, &rec.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	rec.StatusCode = int(statusCode.Int64)
+	if header != nil {
+		err = json.Unmarshal(header, &rec.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func (s *storage) saveIdempotencyResponse(rec *idempotencyRecord) error {
+	query := `UPDATE idempotency_keys
+			  SET status_code = $1, header = $2, body = $3
+			  WHERE user_id = $4 AND key = $5`
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, query, rec.StatusCode, header, rec.Body, rec.UserID, rec.Key)
+	return err
+}
+
+func (s *storage) deleteIdempotencyKey(rec *idempotencyRecord) error {
+	query := `DELETE FROM idempotency_keys
+			  WHERE user_id = $1 AND key = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, rec.UserID, rec.Key)
+	return err
+}
+
+func (s *storage) deleteExpiredIdempotencyKeys() error {
+	query := `DELETE FROM idempotency_keys
+			  WHERE expires_at < NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *storage) insertRefreshToken(t *refreshToken) error {
+	query := `INSERT INTO refresh_tokens (hash, user_id, session_id, expires_at)
+			  VALUES ($1, $2, $3, $4)
+			  RETURNING created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, t.Hash, t.UserID, t.SessionID, t.ExpiresAt).Scan(&t.CreatedAt)
+}
+
+// useRefreshToken marks the token as used and returns it. A token that was
+// already used is returned with UsedAt set so that its reuse can be detected,
+// nil is returned for unknown tokens. Expired tokens aren't marked as used.
+func (s *storage) useRefreshToken(hash []byte) (*refreshToken, error) {
+	query := `UPDATE refresh_tokens
+			  SET used_at = NOW()
+			  WHERE hash = $1 AND used_at IS NULL AND expires_at > NOW()
+			  RETURNING user_id, session_id, created_at, expires_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t := &refreshToken{Hash: hash}
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(&t.UserID, &t.SessionID, &t.CreatedAt, &t.ExpiresAt)
+	if err == nil {
+		return t, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	query = `SELECT user_id, session_id, created_at, expires_at, used_at
+			 FROM refresh_tokens
+			 WHERE hash = $1`
+	err = s.db.QueryRowContext(ctx, query, hash).Scan(&t.UserID, &t.SessionID, &t.CreatedAt, &t.ExpiresAt, &t.UsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (s *storage) deleteExpiredRefreshTokens() error {
+	query := `DELETE FROM refresh_tokens
+			  WHERE expires_at < NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// incrementCredentialVersion invalidates every access token issued to the user
+// so far.
+func (s *storage) incrementCredentialVersion(u *user) error {
+	query := `UPDATE users SET credential_version = credential_version + 1
+			  WHERE id = $1
+			  RETURNING credential_version`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, u.ID).Scan(&u.CredentialVersion)
+}
+
+func (s *storage) insertSession(se *session) error {
+	query := `INSERT INTO sessions (user_id, device_name, user_agent, ip)
+			  VALUES ($1, $2, $3, $4)
+			  RETURNING id, created_at, last_seen_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, se.UserID, se.DeviceName, se.UserAgent, se.IP).Scan(&se.ID, &se.CreatedAt, &se.LastSeenAt)
+}
+
+func (s *storage) getSessionsForUser(u *user) ([]session, error) {
+	query := `SELECT id, user_id, device_name, user_agent, ip, created_at, last_seen_at
+			  FROM sessions
+			  WHERE user_id = $1
+			  ORDER BY last_seen_at DESC, id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []session{}
+	for rows.Next() {
+		var se session
+		err = rows.Scan(&se.ID, &se.UserID, &se.DeviceName, &se.UserAgent, &se.IP, &se.CreatedAt, &se.LastSeenAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, se)
+	}
+	return sessions, rows.Err()
+}
+
+// touchSession reports whether the user's session still exists and records
+// its activity, last_seen_at is only written once a minute to spare a write
+// on every request.
+func (s *storage) touchSession(id, userID int, ip string) (bool, error) {
+	query := `SELECT last_seen_at
+			  FROM sessions
+			  WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var lastSeenAt time.Time
+	err := s.db.QueryRowContext(ctx, query, id, userID).Scan(&lastSeenAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	if time.Since(lastSeenAt) < time.Minute {
+		return true, nil
+	}
+
+	query = `UPDATE sessions SET last_seen_at = NOW(), ip = $1
+			 WHERE id = $2`
+	_, err = s.db.ExecContext(ctx, query, ip, id)
+	return err == nil, err
+}
+
+// deleteSession revokes the user's session and its refresh tokens, it reports
+// whether the session existed.
+func (s *storage) deleteSession(id, userID int) (bool, error) {
+	query := `DELETE FROM sessions
+			  WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
+
+func (s *storage) deleteSessionsForUser(u *user) error {
+	query := `DELETE FROM sessions
+			  WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, u.ID)
+	return err
+}
+
+func (s *storage) revokeToken(jti string, expiresAt time.Time) error {
+	query := `INSERT INTO revoked_tokens (jti, expires_at)
+			  VALUES ($1, $2)
+			  ON CONFLICT (jti) DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, jti, expiresAt)
+	if err != nil {
+		return err
+	}
+	s.onCommit(func() { s.revokedTokens.Set(jti, expiresAt) })
+	return nil
+}
+
+func (s *storage) isTokenRevoked(jti string) bool {
+	return s.revokedTokens.Has(jti)
+}
+
+// syncRevokedTokens loads the tokens revoked since the last sync and drops the
+// expired ones from the cache.
+func (s *storage) syncRevokedTokens() error {
+	query := `SELECT jti, revoked_at, expires_at
+			  FROM revoked_tokens
+			  WHERE revoked_at >= $1 AND expires_at > NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := s.revokedTokens
+	c.mu.RLock()
+	since := c.syncedAt
+	c.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, query, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for rows.Next() {
+		var jti string
+		var revokedAt, expiresAt time.Time
+		err = rows.Scan(&jti, &revokedAt, &expiresAt)
+		if err != nil {
+			return err
+		}
+		c.entries[jti] = expiresAt
+		// revoked_at has a precision of a second, so rows of the same second
+		// are read again on the next sync
+		if revokedAt.After(c.syncedAt) {
+			c.syncedAt = revokedAt
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	for jti, expiresAt := range c.entries {
+		if time.Now().After(expiresAt) {
+			delete(c.entries, jti)
+		}
+	}
+	return nil
+}
+
+func (s *storage) deleteExpiredRevokedTokens() error {
+	query := `DELETE FROM revoked_tokens
+			  WHERE expires_at < NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *storage) insertPersonalAccessToken(t *personalAccessToken) error {
+	query := `INSERT INTO personal_access_tokens (user_id, name, scopes, hash, expires_at)
+			  VALUES ($1, $2, $3, $4, $5)
+			  RETURNING id, created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, t.UserID, t.Name, pq.Array(t.Scopes), t.Hash, t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+func (s *storage) getPersonalAccessTokenByHash(hash []byte) (*personalAccessToken, error) {
+	query := `SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+			  FROM personal_access_tokens
+			  WHERE hash = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t := &personalAccessToken{Hash: hash}
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(&t.ID, &t.UserID, &t.Name, pq.Array(&t.Scopes), &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (s *storage) getPersonalAccessTokensForUser(u *user) ([]personalAccessToken, error) {
+	query := `SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+			  FROM personal_access_tokens
+			  WHERE user_id = $1
+			  ORDER BY created_at DESC, id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []personalAccessToken{}
+	for rows.Next() {
+		var t personalAccessToken
+		err = rows.Scan(&t.ID, &t.UserID, &t.Name, pq.Array(&t.Scopes), &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// touchPersonalAccessToken records the token's use, last_used_at is only
+// written once a minute to spare a write on every request.
+func (s *storage) touchPersonalAccessToken(t *personalAccessToken) error {
+	if t.LastUsedAt != nil && time.Since(*t.LastUsedAt) < time.Minute {
+		return nil
+	}
+	query := `UPDATE personal_access_tokens SET last_used_at = NOW()
+			  WHERE id = $1
+			  RETURNING last_used_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, t.ID).Scan(&t.LastUsedAt)
+}
+
+// deletePersonalAccessToken revokes the user's token, it reports whether the
+// token existed.
+func (s *storage) deletePersonalAccessToken(id, userID int) (bool, error) {
+	query := `DELETE FROM personal_access_tokens
+			  WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
+
+// deletePersonalAccessTokensForUser revokes every token of the user, they are
+// issued on the strength of the password and go with it.
+func (s *storage) deletePersonalAccessTokensForUser(u *user) error {
+	query := `DELETE FROM personal_access_tokens
+			  WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, u.ID)
+	return err
+}
+
+// insertTOTPCredential stores a new unconfirmed TOTP secret for the user, it
+// replaces a previous enrolment that was never confirmed.
+func (s *storage) insertTOTPCredential(c *totpCredential) error {
+	query := `INSERT INTO totp_credentials (user_id, secret)
+			  VALUES ($1, $2)
+			  ON CONFLICT (user_id) DO UPDATE
+			  SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+			  WHERE totp_credentials.confirmed_at IS NULL
+			  RETURNING created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, c.UserID, c.Secret).Scan(&c.CreatedAt)
+}
+
+func (s *storage) getTOTPCredential(userID int) (*totpCredential, error) {
+	query := `SELECT user_id, secret, created_at, confirmed_at, last_used_step
+			  FROM totp_credentials
+			  WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var c totpCredential
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&c.UserID, &c.Secret, &c.CreatedAt, &c.ConfirmedAt, &c.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// useTOTPStep records that the code of the time step was used, it reports
+// false if a code of this or a later step was already accepted so that a code
+// can't be replayed within its window. The credential is confirmed by its
+// first use.
+func (s *storage) useTOTPStep(c *totpCredential, step int64) (bool, error) {
+	query := `UPDATE totp_credentials
+			  SET last_used_step = $2, confirmed_at = COALESCE(confirmed_at, NOW())
+			  WHERE user_id = $1 AND last_used_step < $2
+			  RETURNING confirmed_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.db.QueryRowContext(ctx, query, c.UserID, step).Scan(&c.ConfirmedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	c.LastUsedStep = step
+	return true, nil
+}
+
+// deleteTOTPCredential turns two-factor authentication off for the user, the
+// recovery codes are deleted with the credential.
+func (s *storage) deleteTOTPCredential(userID int) error {
+	query := `DELETE FROM totp_credentials
+			  WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+// replaceRecoveryCodes invalidates the user's recovery codes in favour of the
+// given hashes.
+func (s *storage) replaceRecoveryCodes(userID int, hashes [][]byte) error {
+	query := `WITH deleted AS (
+				DELETE FROM recovery_codes WHERE user_id = $1
+			  )
+			  INSERT INTO recovery_codes (user_id, hash)
+			  SELECT $1, unnest($2::bytea[])`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, userID, pq.Array(hashes))
+	return err
+}
+
+// useRecoveryCode consumes the user's recovery code, it reports false for
+// unknown and already used codes.
+func (s *storage) useRecoveryCode(userID int, hash []byte) (bool, error) {
+	query := `UPDATE recovery_codes SET used_at = NOW()
+			  WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, query, userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
+
+// insertPasswordResetToken stores the token, the user's earlier reset tokens
+// stop working so only the latest email can be used.
+func (s *storage) insertPasswordResetToken(t *passwordResetToken) error {
+	query := `WITH deleted AS (
+				DELETE FROM password_reset_tokens WHERE user_id = $2
+			  )
+			  INSERT INTO password_reset_tokens (hash, user_id, expires_at)
+			  VALUES ($1, $2, $3)
+			  RETURNING created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, t.Hash, t.UserID, t.ExpiresAt).Scan(&t.CreatedAt)
+}
+
+// usePasswordResetToken deletes the token and returns it, nil is returned for
+// unknown and already used tokens.
+func (s *storage) usePasswordResetToken(hash []byte) (*passwordResetToken, error) {
+	query := `DELETE FROM password_reset_tokens
+			  WHERE hash = $1
+			  RETURNING user_id, created_at, expires_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t := &passwordResetToken{Hash: hash}
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(&t.UserID, &t.CreatedAt, &t.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (s *storage) deletePasswordResetTokensForUser(u *user) error {
+	query := `DELETE FROM password_reset_tokens
+			  WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, u.ID)
+	return err
+}
+
+func (s *storage) deleteExpiredPasswordResetTokens() error {
+	query := `DELETE FROM password_reset_tokens
+			  WHERE expires_at < NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// insertEmailChange stores the user's pending email change, it replaces the
+// one pending before.
+func (s *storage) insertEmailChange(c *emailChange) error {
+	query := `INSERT INTO email_changes (user_id, new_email, hash, expires_at)
+			  VALUES ($1, $2, $3, $4)
+			  ON CONFLICT (user_id) DO UPDATE
+			  SET new_email = EXCLUDED.new_email, hash = EXCLUDED.hash, created_at = NOW(), expires_at = EXCLUDED.expires_at
+			  RETURNING created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, c.UserID, c.NewEmail, c.Hash, c.ExpiresAt).Scan(&c.CreatedAt)
+}
+
+func (s *storage) getEmailChange(userID int) (*emailChange, error) {
+	query := `SELECT user_id, new_email, hash, created_at, expires_at
+			  FROM email_changes
+			  WHERE user_id = $1 AND expires_at > NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var c emailChange
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&c.UserID, &c.NewEmail, &c.Hash, &c.CreatedAt, &c.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// useEmailChange deletes the email change of the token and returns it, nil is
+// returned for unknown and already used tokens.
+func (s *storage) useEmailChange(hash []byte) (*emailChange, error) {
+	query := `DELETE FROM email_changes
+			  WHERE hash = $1
+			  RETURNING user_id, new_email, created_at, expires_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := &emailChange{Hash: hash}
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(&c.UserID, &c.NewEmail, &c.CreatedAt, &c.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// deleteEmailChange cancels the user's pending email change, it reports
+// whether one was pending.
+func (s *storage) deleteEmailChange(userID int) (bool, error) {
+	query := `DELETE FROM email_changes
+			  WHERE user_id = $1 AND expires_at > NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
+
+func (s *storage) deleteExpiredEmailChanges() error {
+	query := `DELETE FROM email_changes
+			  WHERE expires_at < NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *storage) insertMagicLink(l *magicLink) error {
+	query := `INSERT INTO magic_links (hash, nonce_hash, user_id, device_name, expires_at)
+			  VALUES ($1, $2, $3, $4, $5)
+			  RETURNING created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, query, l.Hash, l.NonceHash, l.UserID, l.DeviceName, l.ExpiresAt).Scan(&l.CreatedAt)
+}
+
+// useMagicLink deletes the link and returns it, nil is returned for unknown
+// and already used links.
+func (s *storage) useMagicLink(hash []byte) (*magicLink, error) {
+	query := `DELETE FROM magic_links
+			  WHERE hash = $1
+			  RETURNING nonce_hash, user_id, device_name, created_at, expires_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l := &magicLink{Hash: hash}
+	err := s.db.QueryRowContext(ctx, query, hash).Scan(&l.NonceHash, &l.UserID, &l.DeviceName, &l.CreatedAt, &l.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (s *storage) deleteExpiredMagicLinks() error {
+	query := `DELETE FROM magic_links
+			  WHERE expires_at < NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// getAuthFailures returns the failed attempts counted under the key, failures
+// older than window are forgotten.
+func (s *storage) getAuthFailures(key string, window time.Duration) (int, time.Time, error) {
+	query := `SELECT failures, last_failure_at
+			  FROM auth_failures
+			  WHERE key = $1 AND last_failure_at > NOW() - $2::float8 * interval '1 second'`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var failures int
+	var last time.Time
+	err := s.db.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&failures, &last)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, time.Time{}, nil
+		default:
+			return 0, time.Time{}, err
+		}
+	}
+	return failures, last, nil
+}
+
+// recordAuthFailure counts a failed attempt under the key and returns the
+// count, the count starts over if the last failure is older than window.
+func (s *storage) recordAuthFailure(key string, window time.Duration) (int, time.Time, error) {
+	query := `INSERT INTO auth_failures (key, failures)
+			  VALUES ($1, 1)
+			  ON CONFLICT (key) DO UPDATE
+			  SET failures = CASE
+					WHEN auth_failures.last_failure_at > NOW() - $2::float8 * interval '1 second' THEN auth_failures.failures + 1
+					ELSE 1
+				  END,
+				  last_failure_at = NOW()
+			  RETURNING failures, last_failure_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var failures int
+	var last time.Time
+	err := s.db.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&failures, &last)
+	return failures, last, err
+}
+
+func (s *storage) deleteAuthFailures(key string) error {
+	query := `DELETE FROM auth_failures
+			  WHERE key = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query, key)
+	return err
+}
+
+func (s *storage) deleteStaleAuthFailures() error {
+	query := `DELETE FROM auth_failures
+			  WHERE last_failure_at < NOW() - interval '1 day'`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
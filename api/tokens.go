@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// accessTokenClaims are the claims of access tokens, the user id is the
+// subject.
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	CredentialVersion int `json:"credential_version"`
+	SessionID         int `json:"session_id"`
+}
+
+// personalAccessTokenPrefix tells personal access tokens apart from JWTs and
+// makes them recognizable to secret scanners.
+const personalAccessTokenPrefix = "pat_"
+
+const (
+	passwordResetTokenTTL = time.Hour
+	emailChangeTokenTTL   = 24 * time.Hour
+	magicLinkTTL          = 15 * time.Minute
+)
+
+// startSession records a sign-in of the user from the request's device.
+func (app *application) startSession(r *http.Request, u *user, deviceName string) (*session, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	se := &session{
+		UserID:     u.ID,
+		DeviceName: deviceName,
+		UserAgent:  r.UserAgent(),
+		IP:         ip,
+	}
+	err = app.storageFor(r).insertSession(se)
+	if err != nil {
+		return nil, err
+	}
+	return se, nil
+}
+
+// issueTokens signs a short-lived access token for the user's session and
+// stores a new refresh token for it.
+func (app *application) issueTokens(r *http.Request, u *user, sessionID int) (*authTokens, error) {
+	now := time.Now()
+	tokens := &authTokens{
+		TokenExpiresAt:        now.Add(app.config.jwt.accessTokenTTL),
+		RefreshTokenExpiresAt: now.Add(app.config.jwt.refreshTokenTTL),
+	}
+
+	jti, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens.Token, err = app.keys.sign(accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   strconv.Itoa(u.ID),
+			Issuer:    app.config.jwt.issuer,
+			Audience:  jwt.ClaimStrings{app.config.jwt.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(tokens.TokenExpiresAt),
+		},
+		CredentialVersion: u.CredentialVersion,
+		SessionID:         sessionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	tokens.RefreshToken = base64.RawURLEncoding.EncodeToString(b)
+	hash := sha256.Sum256([]byte(tokens.RefreshToken))
+	err = app.storageFor(r).insertRefreshToken(&refreshToken{
+		Hash:      hash[:],
+		UserID:    u.ID,
+		SessionID: sessionID,
+		ExpiresAt: tokens.RefreshTokenExpiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// randomToken returns a 256-bit secret that is safe to put in URLs.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input refreshTokenInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkCond(input.RefreshToken != nil && *input.RefreshToken != "", "refresh_token", "must be provided")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	hash := sha256.Sum256([]byte(*input.RefreshToken))
+	t, err := app.storageFor(r).useRefreshToken(hash[:])
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if t == nil {
+		writeError(w, r, problemInvalidRefreshToken, "")
+		return
+	}
+	if t.UsedAt != nil {
+		// a rotated token is only presented again if it has leaked, so nothing
+		// issued for the session can be trusted anymore, even once it expired.
+		// Atomic batches, whose rollback would undo it, can't rotate tokens.
+		log.Printf("refresh token of session %d was reused, revoking the session", t.SessionID)
+		_, err = app.storageFor(r).deleteSession(t.SessionID, t.UserID)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		writeError(w, r, problemRefreshTokenReused, "the refresh token was already used, its session and every token issued for it were revoked")
+		return
+	}
+	if time.Now().After(t.ExpiresAt) {
+		writeError(w, r, problemInvalidRefreshToken, "")
+		return
+	}
+
+	u, err := app.storageFor(r).getUserByID(t.UserID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u == nil {
+		writeError(w, r, problemUnknownUser, "")
+		return
+	}
+
+	tokens, err := app.issueTokens(r, u, t.SessionID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, tokens, http.StatusCreated)
+}
+
+// logoutHandler revokes the access token of the request and ends its session.
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	t := getAccessTokenFromRequest(r)
+	err := app.storageFor(r).revokeToken(t.ID, t.ExpiresAt)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	_, err = app.storageFor(r).deleteSession(t.SessionID, getUserFromRequest(r).ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "logged out"}, http.StatusOK)
+}
+
+// logoutEverywhereHandler invalidates every access, refresh and personal access
+// token issued to the user.
+func (app *application) logoutEverywhereHandler(w http.ResponseWriter, r *http.Request) {
+	u := getUserFromRequest(r)
+	err := app.revokeCredentials(r, u)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "logged out everywhere"}, http.StatusOK)
+}
+
+func (app *application) revokeCredentials(r *http.Request, u *user) error {
+	err := app.storageFor(r).incrementCredentialVersion(u)
+	if err != nil {
+		return err
+	}
+	err = app.storageFor(r).deleteSessionsForUser(u)
+	if err != nil {
+		return err
+	}
+	return app.storageFor(r).deletePersonalAccessTokensForUser(u)
+}
+
+func (app *application) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	u := getUserFromRequest(r)
+	sessions, err := app.storageFor(r).getSessionsForUser(u)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	current := getAccessTokenFromRequest(r).SessionID
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	writeResponse(w, r, map[string]any{"sessions": sessions}, http.StatusOK)
+}
+
+// deleteSessionHandler signs the user out of a session, its access tokens stop
+// being accepted immediately.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+	found, err := app.storageFor(r).deleteSession(id, getUserFromRequest(r).ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if !found {
+		writeError(w, r, problemSessionNotFound, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "session revoked"}, http.StatusOK)
+}
+
+func (app *application) createPersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input createPersonalAccessTokenInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkCond(input.Name != "", "name", "must be provided")
+	v.checkCond(len(input.Name) <= 255, "name", "must be atmost 255 characters long")
+	v.checkCond(len(input.Scopes) != 0, "scopes", "must be provided")
+	for _, scope := range input.Scopes {
+		v.checkCond(slices.Contains(scopeList, scope), "scopes", fmt.Sprintf("must only contain the values %v", scopeList))
+	}
+	v.checkCond(input.ExpiresAt == nil || input.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	secret := personalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	hash := sha256.Sum256([]byte(secret))
+	slices.Sort(input.Scopes)
+	t := &personalAccessToken{
+		UserID:    getUserFromRequest(r).ID,
+		Name:      input.Name,
+		Scopes:    slices.Compact(input.Scopes),
+		Hash:      hash[:],
+		ExpiresAt: input.ExpiresAt,
+	}
+	err = app.storageFor(r).insertPersonalAccessToken(t)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	// the secret is only ever shown in this response
+	writeResponse(w, r, map[string]any{"token": t, "secret": secret}, http.StatusCreated)
+}
+
+func (app *application) getPersonalAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := app.storageFor(r).getPersonalAccessTokensForUser(getUserFromRequest(r))
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"tokens": tokens}, http.StatusOK)
+}
+
+func (app *application) deletePersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		writeError(w, r, problemInvalidPathParameter, "route parameter {id} must be a positive integer")
+		return
+	}
+	found, err := app.storageFor(r).deletePersonalAccessToken(id, getUserFromRequest(r).ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if !found {
+		writeError(w, r, problemTokenNotFound, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "token revoked"}, http.StatusOK)
+}
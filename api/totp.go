@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpIssuer = "Todo API"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of steps a code is accepted before and after the
+	// current one to make up for clock drift of the authenticator.
+	totpSkew          = 1
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code of the time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1_000_000)
+}
+
+// matchTOTP returns the time step the code was generated for.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// verifyTOTP checks the code against the user's credential and burns its time
+// step, so a code can't be used twice.
+func (app *application) verifyTOTP(r *http.Request, c *totpCredential, code string) (bool, error) {
+	step, ok := matchTOTP(c.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return app.storageFor(r).useTOTPStep(c, step)
+}
+
+func checkTOTPCode(v *validator, key, code string) {
+	_, err := strconv.ParseUint(code, 10, 32)
+	v.checkCond(len(code) == totpDigits && err == nil, key, fmt.Sprintf("must be a %d digit code", totpDigits))
+}
+
+// newRecoveryCodes generates the one-time codes that replace a TOTP code when
+// the authenticator is lost, only their hashes are stored.
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = s[:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// mfaTokenClaims are the claims of the token that stands for a verified
+// password until the second factor is verified too. Its audience differs from
+// the one of access tokens so it's never accepted in their place.
+type mfaTokenClaims struct {
+	jwt.RegisteredClaims
+	CredentialVersion int    `json:"credential_version"`
+	DeviceName        string `json:"device_name"`
+}
+
+func (app *application) mfaAudience() string {
+	return app.config.jwt.audience + "/mfa"
+}
+
+func (app *application) issueMFAChallenge(u *user, deviceName string) (*mfaChallenge, error) {
+	jti, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ch := &mfaChallenge{
+		MFATokenExpiresAt: now.Add(mfaTokenTTL),
+		Methods:           []string{"totp", "recovery_code"},
+	}
+	ch.MFAToken, err = app.keys.sign(mfaTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   strconv.Itoa(u.ID),
+			Issuer:    app.config.jwt.issuer,
+			Audience:  jwt.ClaimStrings{app.mfaAudience()},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(ch.MFATokenExpiresAt),
+		},
+		CredentialVersion: u.CredentialVersion,
+		DeviceName:        deviceName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// verifyMFAHandler completes a sign-in of a user with two-factor
+// authentication, the MFA token is single use.
+func (app *application) verifyMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var input verifyMFAInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	v.checkCond(input.MFAToken != "", "mfa_token", "must be provided")
+	v.checkCond((input.Code == "") != (input.RecoveryCode == ""), "code", "exactly one of code and recovery_code must be provided")
+	if input.Code != "" {
+		checkTOTPCode(v, "code", input.Code)
+	}
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	claims := &mfaTokenClaims{}
+	_, err := jwt.ParseWithClaims(input.MFAToken, claims, app.keys.keyFunc,
+		jwt.WithValidMethods(app.keys.methods()),
+		jwt.WithIssuer(app.config.jwt.issuer),
+		jwt.WithAudience(app.mfaAudience()),
+		jwt.WithLeeway(app.config.jwt.leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInvalidToken, "")
+		return
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || claims.ID == "" || app.storageFor(r).isTokenRevoked(claims.ID) {
+		writeError(w, r, problemInvalidToken, "")
+		return
+	}
+
+	u, err := app.storageFor(r).getUserByID(userID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if u == nil {
+		writeError(w, r, problemUnknownUser, "")
+		return
+	}
+	if claims.CredentialVersion != u.CredentialVersion {
+		writeError(w, r, problemInvalidToken, "the token was issued before the credentials changed")
+		return
+	}
+	c, err := app.storageFor(r).getTOTPCredential(u.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if c == nil || c.ConfirmedAt == nil {
+		writeError(w, r, problemTOTPNotEnrolled, "")
+		return
+	}
+	account := accountAttemptKey(u.Email)
+	if app.throttled(w, r, account, ipAttemptKey(r)) {
+		return
+	}
+
+	if input.Code != "" {
+		ok, err = app.verifyTOTP(r, c, input.Code)
+	} else {
+		ok, err = app.storageFor(r).useRecoveryCode(u.ID, hashRecoveryCode(input.RecoveryCode))
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if !ok {
+		err = app.recordFailedAttempt(u, account, ipAttemptKey(r))
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return
+		}
+		writeError(w, r, problemInvalidMFACode, "")
+		return
+	}
+	err = app.storage.deleteAuthFailures(account.key)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = app.storageFor(r).revokeToken(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	se, err := app.startSession(r, u, claims.DeviceName)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	tokens, err := app.issueTokens(r, u, se.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, tokens, http.StatusCreated)
+}
+
+// enrolTOTPHandler generates a TOTP secret for the user, two-factor
+// authentication is only enabled once a first code confirms the enrolment. It
+// requires the password so a stolen session can't put the account behind an
+// authenticator of its own.
+func (app *application) enrolTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.readPasswordConfirmation(w, r)
+	if !ok {
+		return
+	}
+	c, err := app.storageFor(r).getTOTPCredential(u.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if c != nil && c.ConfirmedAt != nil {
+		writeError(w, r, problemTOTPAlreadyEnabled, "")
+		return
+	}
+
+	c = &totpCredential{UserID: u.ID, Secret: make([]byte, 20)}
+	_, err = rand.Read(c.Secret)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	err = app.storageFor(r).insertTOTPCredential(c)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+
+	secret := totpEncoding.EncodeToString(c.Secret)
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + u.Email,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {totpIssuer},
+			"algorithm": {"SHA1"},
+			"digits":    {strconv.Itoa(totpDigits)},
+			"period":    {strconv.Itoa(totpPeriod)},
+		}.Encode(),
+	}
+	png, err := qrcode.Encode(uri.String(), qrcode.Medium, 256)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, totpEnrolment{
+		Secret: secret,
+		URI:    uri.String(),
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, http.StatusCreated)
+}
+
+// confirmTOTPHandler enables two-factor authentication with the first code of
+// the enrolled authenticator and hands out the recovery codes.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input totpCodeInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return
+	}
+
+	v := newValidator()
+	checkTOTPCode(v, "code", input.Code)
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return
+	}
+
+	u := getUserFromRequest(r)
+	c, err := app.storageFor(r).getTOTPCredential(u.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if c == nil {
+		writeError(w, r, problemTOTPNotEnrolled, "")
+		return
+	}
+	if c.ConfirmedAt != nil {
+		writeError(w, r, problemTOTPAlreadyEnabled, "")
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	// two-factor authentication is only turned on together with its recovery
+	// codes, or a failure would leave it on without any
+	err = app.inTx(r, func(r *http.Request) error {
+		ok, err = app.verifyTOTP(r, c, input.Code)
+		if err != nil || !ok {
+			return err
+		}
+		return app.storageFor(r).replaceRecoveryCodes(u.ID, hashes)
+	})
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if !ok {
+		writeError(w, r, problemInvalidMFACode, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"recovery_codes": codes}, http.StatusCreated)
+}
+
+// disableTOTPHandler turns two-factor authentication off, it requires the
+// password so a stolen session can't do it.
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.readPasswordConfirmation(w, r)
+	if !ok {
+		return
+	}
+	c, err := app.storageFor(r).getTOTPCredential(u.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if c == nil {
+		writeError(w, r, problemTOTPNotEnrolled, "")
+		return
+	}
+	err = app.storageFor(r).deleteTOTPCredential(u.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	writeResponse(w, r, map[string]any{"message": "two-factor authentication disabled"}, http.StatusOK)
+}
+
+// regenerateRecoveryCodesHandler replaces every recovery code of the user,
+// used or not.
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := app.readPasswordConfirmation(w, r)
+	if !ok {
+		return
+	}
+	c, err := app.storageFor(r).getTOTPCredential(u.ID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	if c == nil || c.ConfirmedAt == nil {
+		writeError(w, r, problemTOTPNotEnrolled, "")
+		return
+	}
+	app.writeRecoveryCodes(w, r, u)
+}
+
+func (app *application) writeRecoveryCodes(w http.ResponseWriter, r *http.Request, u *user) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	err = app.storageFor(r).replaceRecoveryCodes(u.ID, hashes)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, problemInternal, "")
+		return
+	}
+	// the codes are only ever shown in this response
+	writeResponse(w, r, map[string]any{"recovery_codes": codes}, http.StatusCreated)
+}
+
+// readPasswordConfirmation reads the password the request must carry and
+// checks it against the authenticated user's.
+func (app *application) readPasswordConfirmation(w http.ResponseWriter, r *http.Request) (*user, bool) {
+	var input passwordInput
+	ok := app.readRequest(w, r, &input)
+	if !ok {
+		return nil, false
+	}
+
+	v := newValidator()
+	v.checkCond(input.Password != "", "password", "must be provided")
+	if v.hasErrors() {
+		writeValidationError(w, r, problemValidationFailed, v)
+		return nil, false
+	}
+
+	u := getUserFromRequest(r)
+	if !app.checkPassword(w, r, u, input.Password) {
+		return nil, false
+	}
+	return u, true
+}
+
+// checkPassword compares the password with the user's, failures count against
+// the account like failed sign-ins do. It writes the error response and
+// returns false when the password is wrong.
+func (app *application) checkPassword(w http.ResponseWriter, r *http.Request, u *user, password string) bool {
+	account := accountAttemptKey(u.Email)
+	if app.throttled(w, r, account) {
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password))
+	if err != nil {
+		err = app.recordFailedAttempt(u, account)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, problemInternal, "")
+			return false
+		}
+		writeError(w, r, problemInvalidCredentials, "")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B, truncated to six digits.
+var rfc6238Secret = []byte("12345678901234567890")
+
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		got := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		step := tt.unix / totpPeriod
+		for skew := int64(-totpSkew); skew <= totpSkew; skew++ {
+			now := time.Unix((step+skew)*totpPeriod, 0)
+			got, ok := matchTOTP(rfc6238Secret, tt.code, now)
+			if !ok || got != step {
+				t.Errorf("matchTOTP(%s) at %d = %d, %t, want %d, true", tt.code, now.Unix(), got, ok, step)
+			}
+		}
+
+		now := time.Unix((step+totpSkew+1)*totpPeriod, 0)
+		if _, ok := matchTOTP(rfc6238Secret, tt.code, now); ok {
+			t.Errorf("matchTOTP(%s) at %d matched outside the allowed skew", tt.code, now.Unix())
+		}
+	}
+}
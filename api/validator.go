@@ -1,13 +1,21 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"fmt"
 	"regexp"
+	"slices"
+	"strings"
 )
 
 var emailRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+var taskSortList = []string{"id", "-id", "created_at", "-created_at", "is_completed", "-is_completed"}
+var taskFieldList = []string{"id", "created_at", "user_id", "content", "is_completed", "completed_at", "updated_at"}
+
+var taskExpandList = []string{"owner", "counts"}
+
+var scopeList = []string{"tasks:read", "tasks:write", "user:read"}
+
 type validator struct {
 	errors map[string]string
 }
@@ -18,15 +26,13 @@ func newValidator() *validator {
 	}
 }
 
-func (v *validator) toError() error {
-	if v == nil {
-		return errors.New("")
-	}
-	data, err := json.Marshal(v.errors)
-	if err != nil {
-		return err
+func (v *validator) violations() []fieldViolation {
+	violations := make([]fieldViolation, 0, len(v.errors))
+	for field, msg := range v.errors {
+		violations = append(violations, fieldViolation{Field: field, Message: msg})
 	}
-	return errors.New(string(data))
+	slices.SortFunc(violations, func(a, b fieldViolation) int { return strings.Compare(a.Field, b.Field) })
+	return violations
 }
 
 func (v *validator) hasErrors() bool {
@@ -52,3 +58,12 @@ func (v *validator) checkPassword(password string) {
 	v.checkCond(len(password) >= 8, "password", "must be atleast 8 characters long")
 	v.checkCond(len(password) <= 72, "password", "must be atmost 72 characters long")
 }
+
+func (v *validator) checkTaskFilter(f taskFilter) {
+	v.checkCond(f.Sort == "" || slices.Contains(taskSortList, f.Sort), "sort", fmt.Sprintf("must be one of the values %v", taskSortList))
+	v.checkCond(f.CreatedAfter == nil || f.CreatedBefore == nil || f.CreatedAfter.Before(*f.CreatedBefore), "created_after", "must be before created_before")
+	v.checkCond(len(f.IDs) <= 100, "ids", "must contain atmost 100 ids")
+	for _, id := range f.IDs {
+		v.checkCond(id > 0, "ids", "must be a comma separated list of positive integers")
+	}
+}
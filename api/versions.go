@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiVersion is a route set served under its own path prefix. Every version
+// shares the handlers and the storage, a version whose shapes differ from the
+// ones the handlers work on lists the types it substitutes and a transform
+// between the two.
+type apiVersion struct {
+	name        string
+	deprecation time.Time
+	sunset      time.Time
+	successor   string
+	substitutes map[reflect.Type]reflect.Type
+	transform   *versionTransform
+}
+
+// versionTransform rewrites requests into the handlers' shapes and responses
+// back into the version's shapes, documents are rewritten in place.
+type versionTransform struct {
+	query    func(q url.Values) []fieldViolation
+	request  func(doc any, path string) []fieldViolation
+	patch    func(ops []any) []fieldViolation
+	response func(doc any)
+	link     func(q url.Values)
+}
+
+func (app *application) apiVersions() []apiVersion {
+	return []apiVersion{
+		{
+			name:        "v1",
+			deprecation: app.config.versions.v1Deprecation,
+			sunset:      app.config.versions.v1Sunset,
+			successor:   "v2",
+		},
+		{
+			name: "v2",
+			substitutes: map[reflect.Type]reflect.Type{
+				reflect.TypeOf(task{}):            reflect.TypeOf(taskV2{}),
+				reflect.TypeOf(taskFilter{}):      reflect.TypeOf(taskFilterV2{}),
+				reflect.TypeOf(updateTaskInput{}): reflect.TypeOf(updateTaskInputV2{}),
+			},
+			transform: taskStatusTransform,
+		},
+	}
+}
+
+// versionOf returns the version a request was routed to by its path prefix.
+func (app *application) versionOf(r *http.Request) apiVersion {
+	versions := app.apiVersions()
+	name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	for _, v := range versions {
+		if v.name == name {
+			return v
+		}
+	}
+	return versions[0]
+}
+
+func (v apiVersion) status(now time.Time) string {
+	switch {
+	case !v.sunset.IsZero() && !now.Before(v.sunset):
+		return "retired"
+	case !v.deprecation.IsZero() && !now.Before(v.deprecation):
+		return "deprecated"
+	default:
+		return "supported"
+	}
+}
+
+// affects reports whether t mentions one of the substituted types, only routes
+// whose request or response does are transformed.
+func (v apiVersion) affects(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == nil || seen[t] {
+		return false
+	}
+	seen[t] = true
+	if _, ok := v.substitutes[t]; ok {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return v.affects(t.Elem(), seen)
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if v.affects(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usageCounter counts requests per version and route so that retiring a
+// version can be based on its remaining traffic.
+type usageCounter struct {
+	mu     sync.Mutex
+	routes map[string]map[string]*routeUsage
+}
+
+func newUsageCounter() *usageCounter {
+	return &usageCounter{
+		routes: make(map[string]map[string]*routeUsage),
+	}
+}
+
+func (u *usageCounter) record(version, route string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.routes[version] == nil {
+		u.routes[version] = make(map[string]*routeUsage)
+	}
+	ru, ok := u.routes[version][route]
+	if !ok {
+		ru = &routeUsage{Route: route}
+		u.routes[version][route] = ru
+	}
+	ru.Requests++
+	ru.LastRequestAt = time.Now().UTC()
+}
+
+func (u *usageCounter) snapshot(version string) []routeUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage := make([]routeUsage, 0, len(u.routes[version]))
+	for _, ru := range u.routes[version] {
+		usage = append(usage, *ru)
+	}
+	slices.SortFunc(usage, func(a, b routeUsage) int { return strings.Compare(a.Route, b.Route) })
+	return usage
+}
+
+// headerWriter calls before right ahead of the status line, so headers can be
+// added after the ones set by the handler.
+type headerWriter struct {
+	http.ResponseWriter
+	before      func(h http.Header)
+	wroteHeader bool
+}
+
+func (hw *headerWriter) WriteHeader(statusCode int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.before(hw.Header())
+	}
+	hw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// versioned counts the route's usage, signals the version's deprecation with
+// RFC 9745 Deprecation and RFC 8594 Sunset headers, and refuses requests once
+// the version is past its sunset.
+func (app *application) versioned(v apiVersion, rt route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app.usage.record(v.name, rt.method+" "+rt.path)
+
+		if !v.deprecation.IsZero() {
+			w = &headerWriter{ResponseWriter: w, before: func(h http.Header) {
+				h.Set("Deprecation", fmt.Sprintf("@%d", v.deprecation.Unix()))
+				if !v.sunset.IsZero() {
+					h.Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+				}
+				if v.successor != "" {
+					successor := "/" + v.successor + strings.TrimPrefix(r.URL.Path, "/"+v.name)
+					h.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+				}
+			}}
+		}
+
+		if v.status(time.Now()) == "retired" {
+			detail := fmt.Sprintf("%s was retired on %s", v.name, v.sunset.UTC().Format(time.DateOnly))
+			if v.successor != "" {
+				detail += ", use " + v.successor + " instead"
+			}
+			writeError(w, r, problemVersionRetired, detail)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// transformVersion translates the route's requests and responses between the
+// version's shapes and the handlers' when the route is affected by them.
+func (app *application) transformVersion(v apiVersion, rt route, next http.HandlerFunc) http.HandlerFunc {
+	t := v.transform
+	if t == nil {
+		return next
+	}
+	if !v.affects(reflect.TypeOf(rt.request), map[reflect.Type]bool{}) && !v.affects(reflect.TypeOf(rt.response), map[reflect.Type]bool{}) {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		violations := t.query(query)
+		r.URL.RawQuery = query.Encode()
+
+		if r.Body != nil && r.Body != http.NoBody {
+			body, ok := app.readBody(w, r)
+			if !ok {
+				return
+			}
+			// bodies that can't be decoded are left for the handler to report
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			switch c := codecFor(mediaType); {
+			case mediaType == "application/json-patch+json":
+				var ops []any
+				if json.Unmarshal(body, &ops) == nil {
+					violations = append(violations, t.patch(ops)...)
+					body, _ = json.Marshal(ops)
+				}
+			case mediaType == "application/merge-patch+json":
+				var doc any
+				if json.Unmarshal(body, &doc) == nil {
+					violations = append(violations, t.request(doc, "")...)
+					body, _ = json.Marshal(doc)
+				}
+			case c != nil:
+				doc, err := c.decode(body)
+				if err == nil {
+					violations = append(violations, t.request(doc, "")...)
+					body, _ = json.Marshal(doc)
+					r.Header.Set("Content-Type", jsonCodec.mediaType)
+				}
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		if len(violations) != 0 {
+			p := newProblem(r, problemValidationFailed, "one or more fields are invalid")
+			p.Errors = violations
+			writeProblem(w, r, p)
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		next(rec, r)
+
+		body := rec.Body.Bytes()
+		mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		c := codecFor(mediaType)
+		if mediaType == "application/problem+json" {
+			c = jsonCodec
+		}
+		if c != nil && len(body) != 0 {
+			doc, err := c.decode(body)
+			if err == nil {
+				t.response(doc)
+				transformed, err := c.encode(doc)
+				if err == nil {
+					body = transformed
+				}
+			}
+		}
+
+		links := rec.Header().Values("Link")
+		rec.Header().Del("Link")
+		for _, link := range links {
+			rec.Header().Add("Link", transformLink(link, t))
+		}
+
+		for k, vs := range rec.Header() {
+			w.Header()[k] = vs
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	}
+}
+
+// transformLink rewrites the query of every target in a Link header value.
+func transformLink(link string, t *versionTransform) string {
+	parts := strings.Split(link, ", <")
+	for i, part := range parts {
+		target, params, ok := strings.Cut(strings.TrimPrefix(part, "<"), ">")
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(target)
+		if err != nil {
+			continue
+		}
+		q := u.Query()
+		t.link(q)
+		u.RawQuery = q.Encode()
+		parts[i] = "<" + u.String() + ">" + params
+	}
+	return strings.Join(parts, ", ")
+}
+
+// taskStatusTransform maps the v2 task status onto the v1 completion flag.
+var taskStatusTransform = &versionTransform{
+	query: func(q url.Values) []fieldViolation {
+		var violations []fieldViolation
+		if q.Has("status") {
+			completed, ok := parseTaskStatus(q.Get("status"))
+			if !ok {
+				violations = append(violations, fieldViolation{Field: "status", Message: statusViolation})
+			}
+			q.Del("status")
+			q.Set("is_completed", strconv.FormatBool(completed))
+		}
+		renameQueryField(q, "status", "is_completed")
+		return violations
+	},
+	request: transformStatusRequest,
+	patch: func(ops []any) []fieldViolation {
+		var violations []fieldViolation
+		for i, item := range ops {
+			op, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			if p, ok := op["path"].(string); ok && strings.HasSuffix(p, "/sort") {
+				if sort, ok := op["value"].(string); ok {
+					op["value"] = renameSortField(sort, "status", "is_completed")
+				}
+			}
+			for _, key := range []string{"path", "from"} {
+				if p, ok := op[key].(string); ok && (p == "/status" || strings.HasSuffix(p, "/status")) {
+					op[key] = strings.TrimSuffix(p, "status") + "is_completed"
+					if key == "path" {
+						if s, ok := op["value"].(string); ok {
+							completed, ok := parseTaskStatus(s)
+							if !ok {
+								violations = append(violations, fieldViolation{Field: fmt.Sprintf("[%d].value", i), Message: statusViolation})
+							}
+							op["value"] = completed
+						}
+					}
+				}
+			}
+		}
+		return violations
+	},
+	response: transformStatusResponse,
+	link: func(q url.Values) {
+		if q.Has("is_completed") {
+			completed, _ := strconv.ParseBool(q.Get("is_completed"))
+			q.Del("is_completed")
+			q.Set("status", formatTaskStatus(completed))
+		}
+		renameQueryField(q, "is_completed", "status")
+	},
+}
+
+const statusViolation = `must be one of "open", "completed"`
+
+func parseTaskStatus(s string) (completed bool, ok bool) {
+	switch s {
+	case taskStatusOpen:
+		return false, true
+	case taskStatusCompleted:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+func formatTaskStatus(completed bool) string {
+	if completed {
+		return taskStatusCompleted
+	}
+	return taskStatusOpen
+}
+
+// renameQueryField renames a field referenced by the sort and fields
+// parameters.
+func renameQueryField(q url.Values, from, to string) {
+	if q.Has("sort") {
+		q.Set("sort", renameSortField(q.Get("sort"), from, to))
+	}
+	if q.Has("fields") {
+		fields := strings.Split(q.Get("fields"), ",")
+		for i, f := range fields {
+			if strings.TrimSpace(f) == from {
+				fields[i] = to
+			}
+		}
+		q.Set("fields", strings.Join(fields, ","))
+	}
+}
+
+// renameSortField renames the field a sort order, as of the sort parameter or
+// a saved filter, is on and keeps its direction.
+func renameSortField(sort, from, to string) string {
+	if strings.TrimPrefix(sort, "-") == from {
+		return strings.Replace(sort, from, to, 1)
+	}
+	return sort
+}
+
+func transformStatusRequest(doc any, path string) []fieldViolation {
+	var violations []fieldViolation
+	switch doc := doc.(type) {
+	case []any:
+		for i, item := range doc {
+			violations = append(violations, transformStatusRequest(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case map[string]any:
+		field := func(name string) string {
+			if path == "" {
+				return name
+			}
+			return path + "." + name
+		}
+		for k, item := range doc {
+			violations = append(violations, transformStatusRequest(item, field(k))...)
+		}
+		if _, ok := doc["is_completed"]; ok {
+			violations = append(violations, fieldViolation{Field: field("is_completed"), Message: "is not a known field"})
+		}
+		// saved filters sort like the sort parameter
+		if sort, ok := doc["sort"].(string); ok {
+			doc["sort"] = renameSortField(sort, "status", "is_completed")
+		}
+		if status, ok := doc["status"]; ok {
+			delete(doc, "status")
+			switch status := status.(type) {
+			case nil:
+				doc["is_completed"] = nil
+			case string:
+				completed, ok := parseTaskStatus(status)
+				if !ok {
+					violations = append(violations, fieldViolation{Field: field("status"), Message: statusViolation})
+				}
+				doc["is_completed"] = completed
+			default:
+				violations = append(violations, fieldViolation{Field: field("status"), Message: statusViolation})
+			}
+		}
+	}
+	return violations
+}
+
+func transformStatusResponse(doc any) {
+	switch doc := doc.(type) {
+	case []any:
+		for _, item := range doc {
+			transformStatusResponse(item)
+		}
+	case map[string]any:
+		for _, item := range doc {
+			transformStatusResponse(item)
+		}
+		if completed, ok := doc["is_completed"].(bool); ok {
+			delete(doc, "is_completed")
+			doc["status"] = formatTaskStatus(completed)
+		}
+		if sort, ok := doc["sort"].(string); ok {
+			doc["sort"] = renameSortField(sort, "is_completed", "status")
+		}
+		// field violations of problem details
+		if field, ok := doc["field"].(string); ok {
+			segments := strings.Split(field, ".")
+			for i, s := range segments {
+				if s == "is_completed" {
+					segments[i] = "status"
+				}
+			}
+			doc["field"] = strings.Join(segments, ".")
+		}
+	}
+}
+
+func (app *application) getVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var versions []apiVersionInfo
+	for _, v := range app.apiVersions() {
+		info := apiVersionInfo{
+			Name:      v.name,
+			Status:    v.status(now),
+			Successor: v.successor,
+			Usage:     app.usage.snapshot(v.name),
+		}
+		if !v.deprecation.IsZero() {
+			info.Deprecation = &v.deprecation
+		}
+		if !v.sunset.IsZero() {
+			info.Sunset = &v.sunset
+		}
+		versions = append(versions, info)
+	}
+	writeResponse(w, r, map[string]any{"versions": versions}, http.StatusOK)
+}
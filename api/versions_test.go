@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestTaskStatusQuery(t *testing.T) {
+	tests := []struct {
+		query      string
+		want       string
+		violations []fieldViolation
+	}{
+		{"status=open", "is_completed=false", nil},
+		{"status=completed&page=2", "is_completed=true&page=2", nil},
+		{"status=done", "is_completed=false", []fieldViolation{{Field: "status", Message: statusViolation}}},
+		{"sort=status", "sort=is_completed", nil},
+		{"sort=-status", "sort=-is_completed", nil},
+		{"sort=-created_at", "sort=-created_at", nil},
+		{"fields=id,status,content", "fields=id%2Cis_completed%2Ccontent", nil},
+		{"content=status", "content=status", nil},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		violations := taskStatusTransform.query(q)
+		if got := q.Encode(); got != tt.want || !slices.Equal(violations, tt.violations) {
+			t.Errorf("query(%s) = %s, %v, want %s, %v", tt.query, got, violations, tt.want, tt.violations)
+		}
+	}
+}
+
+func TestTaskStatusRequest(t *testing.T) {
+	tests := []struct {
+		doc        string
+		want       string
+		violations []fieldViolation
+	}{
+		{`{"content":"a","status":"completed"}`, `{"content":"a","is_completed":true}`, nil},
+		{`{"status":"open"}`, `{"is_completed":false}`, nil},
+		{`{"status":null}`, `{"is_completed":null}`, nil},
+		{`{"status":"done"}`, `{"is_completed":false}`, []fieldViolation{{Field: "status", Message: statusViolation}}},
+		{`{"status":true}`, `{}`, []fieldViolation{{Field: "status", Message: statusViolation}}},
+		{`{"is_completed":true}`, `{"is_completed":true}`, []fieldViolation{{Field: "is_completed", Message: "is not a known field"}}},
+		{`{"name":"a","filter":{"status":"open","sort":"-status"}}`, `{"name":"a","filter":{"is_completed":false,"sort":"-is_completed"}}`, nil},
+		{`{"filter":{"sort":"status"}}`, `{"filter":{"sort":"is_completed"}}`, nil},
+		{`{"filter":{"sort":"-created_at"}}`, `{"filter":{"sort":"-created_at"}}`, nil},
+		{`{"filter":{"status":"done"}}`, `{"filter":{"is_completed":false}}`, []fieldViolation{{Field: "filter.status", Message: statusViolation}}},
+		{`[{"status":"open"},{"status":"done"}]`, `[{"is_completed":false},{"is_completed":false}]`, []fieldViolation{{Field: "[1].status", Message: statusViolation}}},
+	}
+	for _, tt := range tests {
+		doc := decodeTestJSON(t, tt.doc)
+		violations := taskStatusTransform.request(doc, "")
+		if want := decodeTestJSON(t, tt.want); !reflect.DeepEqual(doc, want) || !slices.Equal(violations, tt.violations) {
+			t.Errorf("request(%s) = %s, %v, want %s, %v", tt.doc, encodeTestJSON(t, doc), violations, tt.want, tt.violations)
+		}
+	}
+}
+
+func TestTaskStatusPatch(t *testing.T) {
+	tests := []struct {
+		ops        string
+		want       string
+		violations []fieldViolation
+	}{
+		{`[{"op":"replace","path":"/status","value":"completed"}]`, `[{"op":"replace","path":"/is_completed","value":true}]`, nil},
+		{`[{"op":"test","path":"/status","value":"open"}]`, `[{"op":"test","path":"/is_completed","value":false}]`, nil},
+		{`[{"op":"remove","path":"/filter/status"}]`, `[{"op":"remove","path":"/filter/is_completed"}]`, nil},
+		{`[{"op":"move","from":"/status","path":"/content"}]`, `[{"op":"move","from":"/is_completed","path":"/content"}]`, nil},
+		{`[{"op":"replace","path":"/filter/sort","value":"-status"}]`, `[{"op":"replace","path":"/filter/sort","value":"-is_completed"}]`, nil},
+		{`[{"op":"replace","path":"/content","value":"status"}]`, `[{"op":"replace","path":"/content","value":"status"}]`, nil},
+		{
+			`[{"op":"replace","path":"/content","value":"a"},{"op":"replace","path":"/status","value":"done"}]`,
+			`[{"op":"replace","path":"/content","value":"a"},{"op":"replace","path":"/is_completed","value":false}]`,
+			[]fieldViolation{{Field: "[1].value", Message: statusViolation}},
+		},
+	}
+	for _, tt := range tests {
+		ops := decodeTestJSON(t, tt.ops).([]any)
+		violations := taskStatusTransform.patch(ops)
+		if want := decodeTestJSON(t, tt.want); !reflect.DeepEqual(any(ops), want) || !slices.Equal(violations, tt.violations) {
+			t.Errorf("patch(%s) = %s, %v, want %s, %v", tt.ops, encodeTestJSON(t, ops), violations, tt.want, tt.violations)
+		}
+	}
+}
+
+func TestTaskStatusResponse(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`{"task":{"id":1,"is_completed":true}}`, `{"task":{"id":1,"status":"completed"}}`},
+		{`{"tasks":[{"id":1,"is_completed":false},{"id":2,"is_completed":true}]}`, `{"tasks":[{"id":1,"status":"open"},{"id":2,"status":"completed"}]}`},
+		{`{"filter":{"id":1,"filter":{"is_completed":true,"sort":"-is_completed"}}}`, `{"filter":{"id":1,"filter":{"status":"completed","sort":"-status"}}}`},
+		{`{"filter":{"filter":{"sort":"created_at"}}}`, `{"filter":{"filter":{"sort":"created_at"}}}`},
+		{
+			`{"code":"validation_failed","errors":[{"field":"is_completed","message":"must be provided"},{"field":"filter.is_completed","message":"must be provided"}]}`,
+			`{"code":"validation_failed","errors":[{"field":"status","message":"must be provided"},{"field":"filter.status","message":"must be provided"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		doc := decodeTestJSON(t, tt.doc)
+		taskStatusTransform.response(doc)
+		if want := decodeTestJSON(t, tt.want); !reflect.DeepEqual(doc, want) {
+			t.Errorf("response(%s) = %s, want %s", tt.doc, encodeTestJSON(t, doc), tt.want)
+		}
+	}
+}
+
+func TestTransformLink(t *testing.T) {
+	link := `<http://example.com/v2/tasks?is_completed=true&page=1&sort=-is_completed>; rel="first", ` +
+		`<http://example.com/v2/tasks?fields=id%2Cis_completed&page=2>; rel="next"`
+	want := `<http://example.com/v2/tasks?page=1&sort=-status&status=completed>; rel="first", ` +
+		`<http://example.com/v2/tasks?fields=id%2Cstatus&page=2>; rel="next"`
+	if got := transformLink(link, taskStatusTransform); got != want {
+		t.Errorf("transformLink = %s, want %s", got, want)
+	}
+}
+
+func TestRenameSortField(t *testing.T) {
+	tests := []struct {
+		sort, from, to string
+		want           string
+	}{
+		{"status", "status", "is_completed", "is_completed"},
+		{"-status", "status", "is_completed", "-is_completed"},
+		{"-is_completed", "is_completed", "status", "-status"},
+		{"created_at", "status", "is_completed", "created_at"},
+		{"--status", "status", "is_completed", "--status"},
+		{"", "status", "is_completed", ""},
+	}
+	for _, tt := range tests {
+		if got := renameSortField(tt.sort, tt.from, tt.to); got != tt.want {
+			t.Errorf("renameSortField(%q, %q, %q) = %q, want %q", tt.sort, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func decodeTestJSON(t *testing.T, s string) any {
+	t.Helper()
+	var doc any
+	err := json.Unmarshal([]byte(s), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func encodeTestJSON(t *testing.T, doc any) string {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS filters(
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id int REFERENCES users(id) ON DELETE CASCADE,
+    name varchar(255) NOT NULL,
+    query jsonb NOT NULL DEFAULT '{}',
+    last_viewed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
\ No newline at end of file
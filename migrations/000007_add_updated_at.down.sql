@@ -0,0 +1,2 @@
+ALTER TABLE tasks DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE users DROP COLUMN IF EXISTS updated_at;
\ No newline at end of file
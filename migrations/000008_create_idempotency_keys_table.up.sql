@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+    user_id bigint NOT NULL,
+    key varchar(255) NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL,
+    fingerprint bytea NOT NULL,
+    status_code integer,
+    header jsonb,
+    body bytea,
+    PRIMARY KEY (user_id, key)
+);
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens(
+    jti varchar(64) PRIMARY KEY,
+    revoked_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_revoked_at_idx ON revoked_tokens(revoked_at);
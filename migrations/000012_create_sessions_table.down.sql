@@ -0,0 +1,7 @@
+DELETE FROM refresh_tokens;
+DROP INDEX IF EXISTS refresh_tokens_session_id_idx;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS session_id;
+ALTER TABLE refresh_tokens ADD COLUMN family varchar(64) NOT NULL;
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens(family);
+
+DROP TABLE IF EXISTS sessions;
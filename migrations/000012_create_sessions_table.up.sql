@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS sessions(
+    id bigserial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_name varchar(255) NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    ip varchar(45) NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_seen_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
+
+-- refresh tokens issued before sessions existed can't be attributed to one
+DELETE FROM refresh_tokens;
+DROP INDEX IF EXISTS refresh_tokens_family_idx;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS family;
+ALTER TABLE refresh_tokens ADD COLUMN session_id bigint NOT NULL REFERENCES sessions(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens(session_id);
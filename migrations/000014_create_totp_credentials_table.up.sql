@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS totp_credentials(
+    user_id int PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret bytea NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    confirmed_at timestamp(0) with time zone,
+    last_used_step bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes(
+    id bigserial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES totp_credentials(user_id) ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes(user_id);
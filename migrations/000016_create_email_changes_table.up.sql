@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS email_changes(
+    user_id int PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    new_email citext NOT NULL,
+    hash bytea UNIQUE NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL
+);
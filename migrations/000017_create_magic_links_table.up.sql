@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS magic_links(
+    hash bytea PRIMARY KEY,
+    nonce_hash bytea NOT NULL,
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_name varchar(255) NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS magic_links_user_id_idx ON magic_links(user_id);
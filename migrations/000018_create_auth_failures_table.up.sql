@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS auth_failures(
+    key text PRIMARY KEY,
+    failures int NOT NULL,
+    last_failure_at timestamp with time zone NOT NULL DEFAULT NOW()
+);